@@ -0,0 +1,423 @@
+// Package alicloudapislimtest provides a simulator of the Market and Wuliu
+// APIs for integration tests of code using alicloudapislim.
+package alicloudapislimtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caiguanhao/alicloudapislim"
+)
+
+// Server serves DescribeApiMetering, DescribeProduct, DescribePrice,
+// DescribeInstances and CreateOrder of the Market API and getExpressList, exCompany and kdi of the
+// Wuliu API from the fixtures in its fields, which can be changed at any time
+// while holding Lock.
+type Server struct {
+	*httptest.Server
+	sync.Mutex
+
+	AppCode       string                                          // required Wuliu AppCode if not empty
+	PageSize      int                                             // metering page size, defaults to 10
+	StringNumbers bool                                            // encode numbers of the metering as strings
+	Products      []alicloudapislim.MarketProduct                 // metering of DescribeApiMetering
+	Details       map[string]alicloudapislim.MarketProductDetails // by product code
+	Prices        map[string]Price                                // by product code and option code, see PriceKey
+	Instances     []alicloudapislim.MarketInstance                // of DescribeInstances, with numeric ids
+	Providers     map[string]string                               // carrier names by code
+	Shipments     map[string]Shipment                             // by tracking number
+
+	// VerifySignatures rejects Market requests whose signature does not
+	// match with SignatureDoesNotMatch, like the real api. The secret is the
+	// one of NewMarketClient.
+	VerifySignatures bool
+
+	// Orders are the orders created by CreateOrder, oldest first. Orders
+	// with the ClientToken of an earlier one are not created again. Renewals
+	// need an instance of Instances instead of a price.
+	Orders []Order
+}
+
+// Order is a request of CreateOrder.
+type Order struct {
+	OrderId     string
+	OrderType   string
+	PaymentType string
+	ClientToken string
+	Commodity   json.RawMessage
+}
+
+const (
+	testAccessKeyId     = "testid"
+	testAccessKeySecret = "testsecret"
+)
+
+type Price struct {
+	TradePrice    float64
+	OriginalPrice float64 // defaults to TradePrice
+	Duration      int
+	Cycle         string
+}
+
+type Shipment struct {
+	Code           string // carrier code
+	CompanyName    string
+	DeliveryStatus string // "0" to "6"
+	Items          []alicloudapislim.WuliuStatusItem
+}
+
+func PriceKey(productCode, optionCode string) string {
+	return productCode + "/" + optionCode
+}
+
+// NewServer starts a new simulator. Close it when done.
+func NewServer() *Server {
+	server := &Server{
+		Details:   map[string]alicloudapislim.MarketProductDetails{},
+		Prices:    map[string]Price{},
+		Providers: map[string]string{},
+		Shipments: map[string]Shipment{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", server.serveMarket)
+	mux.HandleFunc("/getExpressList", server.wuliu(server.serveExpressList))
+	mux.HandleFunc("/exCompany", server.wuliu(server.serveExCompany))
+	mux.HandleFunc("/kdi", server.wuliu(server.serveKdi))
+	server.Server = httptest.NewServer(mux)
+	return server
+}
+
+// NewMarketClient returns a MarketClient using the simulator.
+func (server *Server) NewMarketClient() *alicloudapislim.MarketClient {
+	client := alicloudapislim.NewMarketClient(testAccessKeyId, testAccessKeySecret)
+	client.Endpoint = server.URL
+	return client
+}
+
+// NewWuliuClient returns a WuliuClient using the simulator.
+func (server *Server) NewWuliuClient() *alicloudapislim.WuliuClient {
+	client := alicloudapislim.NewWuliuClient(server.AppCode)
+	client.Endpoint = server.URL
+	return client
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeMarketError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string]string{"Code": code, "Message": message})
+}
+
+func (server *Server) serveMarket(w http.ResponseWriter, r *http.Request) {
+	server.Lock()
+	defer server.Unlock()
+	query := r.URL.Query()
+	if server.VerifySignatures && query.Get("Signature") != alicloudapislim.ComputeSignature(r.Method, r.URL.Path, query, testAccessKeySecret) {
+		writeMarketError(w, http.StatusBadRequest, "SignatureDoesNotMatch", "Specified signature is not matched with our calculation.")
+		return
+	}
+	switch query.Get("Action") {
+	case "DescribeApiMetering":
+		server.serveMetering(w, r)
+	case "DescribeProduct":
+		server.serveProduct(w, r)
+	case "DescribePrice":
+		server.servePrice(w, r)
+	case "DescribeInstances":
+		server.serveInstances(w, r)
+	case "CreateOrder":
+		server.serveCreateOrder(w, r)
+	default:
+		writeMarketError(w, http.StatusBadRequest, "InvalidAction.NotFound", "Specified api is not found, please check your url and method.")
+	}
+}
+
+func (server *Server) serveMetering(w http.ResponseWriter, r *http.Request) {
+	pageSize := server.PageSize
+	if pageSize <= 0 {
+		pageSize = 10
+	}
+	pageNum, _ := strconv.Atoi(r.URL.Query().Get("pageNum"))
+	if pageNum < 1 {
+		pageNum = 1
+	}
+	number := func(n int) interface{} {
+		if server.StringNumbers {
+			return strconv.Itoa(n)
+		}
+		return n
+	}
+	results := []map[string]interface{}{}
+	for i := (pageNum - 1) * pageSize; i < pageNum*pageSize && i < len(server.Products); i++ {
+		product := server.Products[i]
+		results = append(results, map[string]interface{}{
+			"ProductName": product.Name,
+			"ProductCode": product.Id,
+			"TotalQuota":  number(product.Remaining),
+			"TotalUsage":  number(product.Used),
+			"Unit":        product.Unit,
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"Success":    true,
+		"Code":       "200",
+		"Count":      number(len(server.Products)),
+		"PageSize":   number(pageSize),
+		"PageNumber": number(pageNum),
+		"Result":     results,
+	})
+}
+
+func (server *Server) serveProduct(w http.ResponseWriter, r *http.Request) {
+	code := r.URL.Query().Get("Code")
+	details, ok := server.Details[code]
+	if !ok {
+		writeMarketError(w, http.StatusNotFound, "isv.PRODUCT_NOT_FOUND", "product "+code+" not found")
+		return
+	}
+	type value struct {
+		Type        string
+		DisplayName string
+		Value       string
+	}
+	values := []value{}
+	for _, option := range details.Options {
+		values = append(values, value{"enum", option.Name, option.Code})
+	}
+	property := map[string]interface{}{
+		"Key":            "package_version",
+		"PropertyValues": map[string]interface{}{"PropertyValue": values},
+	}
+	module := map[string]interface{}{
+		"Code":       "package_version",
+		"Properties": map[string]interface{}{"Property": []interface{}{property}},
+	}
+	sku := map[string]interface{}{
+		"ChargeType": "PREPAY",
+		"Modules":    map[string]interface{}{"Module": []interface{}{module}},
+	}
+	productType := details.Type
+	if productType == "" {
+		productType = alicloudapislim.ProductTypeAPI
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"Code":             details.Id,
+		"Name":             details.Name,
+		"ShortDescription": details.Description,
+		"Type":             productType,
+		"ProductSkus":      map[string]interface{}{"ProductSku": []interface{}{sku}},
+	})
+}
+
+func (server *Server) serveInstances(w http.ResponseWriter, r *http.Request) {
+	pageSize, _ := strconv.Atoi(r.URL.Query().Get("PageSize"))
+	if pageSize < 1 {
+		pageSize = 10
+	}
+	pageNum, _ := strconv.Atoi(r.URL.Query().Get("PageNumber"))
+	if pageNum < 1 {
+		pageNum = 1
+	}
+	millis := func(t time.Time) int64 {
+		if t.IsZero() {
+			return 0
+		}
+		return t.UnixMilli()
+	}
+	items := []map[string]interface{}{}
+	for i := (pageNum - 1) * pageSize; i < pageNum*pageSize && i < len(server.Instances); i++ {
+		instance := server.Instances[i]
+		id, _ := strconv.ParseInt(instance.Id, 10, 64)
+		items = append(items, map[string]interface{}{
+			"InstanceId":     id,
+			"ProductCode":    instance.ProductCode,
+			"ProductName":    instance.ProductName,
+			"ProductSkuCode": instance.SkuCode,
+			"Status":         instance.Status,
+			"CreatedOn":      millis(instance.CreatedAt),
+			"BeganOn":        millis(instance.BeganAt),
+			"EndOn":          millis(instance.ExpiredAt),
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"PageNumber":    pageNum,
+		"PageSize":      pageSize,
+		"TotalCount":    len(server.Instances),
+		"InstanceItems": map[string]interface{}{"InstanceItem": items},
+	})
+}
+
+func (server *Server) commodity(w http.ResponseWriter, r *http.Request) *alicloudapislim.Commodity {
+	var c alicloudapislim.Commodity
+	if err := json.Unmarshal([]byte(r.URL.Query().Get("Commodity")), &c); err != nil {
+		writeMarketError(w, http.StatusBadRequest, "InvalidCommodity", err.Error())
+		return nil
+	}
+	return &c
+}
+
+func (server *Server) price(w http.ResponseWriter, r *http.Request) (*alicloudapislim.Commodity, *Price) {
+	c := server.commodity(w, r)
+	if c == nil {
+		return nil, nil
+	}
+	price, ok := server.Prices[PriceKey(c.ProductCode, c.Components["package_version"])]
+	if !ok {
+		writeMarketError(w, http.StatusNotFound, "isv.PRODUCT_NOT_FOUND", "no price for "+c.ProductCode)
+		return nil, nil
+	}
+	return c, &price
+}
+
+// instance returns the instance of the commodity of a renewal.
+func (server *Server) instance(w http.ResponseWriter, r *http.Request) *alicloudapislim.MarketInstance {
+	c := server.commodity(w, r)
+	if c == nil {
+		return nil
+	}
+	for i, instance := range server.Instances {
+		if instance.Id == c.InstanceId && instance.ProductCode == c.ProductCode {
+			return &server.Instances[i]
+		}
+	}
+	writeMarketError(w, http.StatusNotFound, "InvalidInstance.NotFound", "instance "+c.InstanceId+" not found")
+	return nil
+}
+
+func (server *Server) servePrice(w http.ResponseWriter, r *http.Request) {
+	c, price := server.price(w, r)
+	if price == nil {
+		return
+	}
+	originalPrice := price.OriginalPrice
+	if originalPrice == 0 {
+		originalPrice = price.TradePrice
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"ProductCode":   c.ProductCode,
+		"TradePrice":    price.TradePrice,
+		"OriginalPrice": originalPrice,
+		"DiscountPrice": originalPrice - price.TradePrice,
+		"Currency":      "CNY",
+		"Duration":      price.Duration,
+		"Cycle":         price.Cycle,
+	})
+}
+
+func (server *Server) serveCreateOrder(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("OrderType") == alicloudapislim.OrderTypeRenew {
+		if server.instance(w, r) == nil {
+			return
+		}
+	} else if _, price := server.price(w, r); price == nil {
+		return
+	}
+	order := Order{
+		OrderType:   query.Get("OrderType"),
+		PaymentType: query.Get("PaymentType"),
+		ClientToken: query.Get("ClientToken"),
+		Commodity:   json.RawMessage(query.Get("Commodity")),
+	}
+	for _, created := range server.Orders {
+		if order.ClientToken != "" && created.ClientToken == order.ClientToken {
+			order = created
+			break
+		}
+	}
+	if order.OrderId == "" {
+		order.OrderId = fmt.Sprintf("2000%08d", len(server.Orders)+1)
+		server.Orders = append(server.Orders, order)
+	}
+	orderId := order.OrderId
+	resp := map[string]interface{}{
+		"OrderId": orderId,
+	}
+	if order.PaymentType == alicloudapislim.PaymentTypeHand {
+		resp["PayUrl"] = server.URL + "/pay?orderId=" + orderId
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (server *Server) wuliu(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		server.Lock()
+		defer server.Unlock()
+		if server.AppCode != "" && r.Header.Get("Authorization") != "APPCODE "+server.AppCode {
+			w.Header().Set("X-Ca-Error-Message", "Invalid AppCode `not exists`")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (server *Server) serveExpressList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "200",
+		"msg":    "ok",
+		"result": server.Providers,
+	})
+}
+
+func (server *Server) serveExCompany(w http.ResponseWriter, r *http.Request) {
+	no := r.URL.Query().Get("no")
+	shipment, ok := server.Shipments[no]
+	if !ok {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "204", "msg": "快递公司识别失败"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "0",
+		"msg":    "ok",
+		"number": no,
+		"list":   []map[string]string{{"type": shipment.Code, "name": server.Providers[shipment.Code]}},
+	})
+}
+
+var loc = time.FixedZone("UTC+8", 8*60*60)
+
+func (server *Server) serveKdi(w http.ResponseWriter, r *http.Request) {
+	no := r.URL.Query().Get("no")
+	shipment, ok := server.Shipments[no]
+	if !ok || shipment.Code != r.URL.Query().Get("type") {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "205", "msg": "没有信息"})
+		return
+	}
+	list := []map[string]string{}
+	var updatedAt time.Time
+	for _, item := range shipment.Items {
+		list = append(list, map[string]string{
+			"time":   item.Time.In(loc).Format("2006-01-02 15:04:05"),
+			"status": item.Desc,
+		})
+		if item.Time.After(updatedAt) {
+			updatedAt = item.Time
+		}
+	}
+	isSign := "0"
+	if shipment.DeliveryStatus == "3" {
+		isSign = "1"
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "0",
+		"msg":    "ok",
+		"result": map[string]interface{}{
+			"number":         no,
+			"type":           shipment.Code,
+			"list":           list,
+			"deliverystatus": shipment.DeliveryStatus,
+			"issign":         isSign,
+			"expName":        shipment.CompanyName,
+			"updateTime":     updatedAt.In(loc).Format("2006-01-02 15:04:05"),
+		},
+	})
+}
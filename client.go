@@ -0,0 +1,444 @@
+package alicloudapislim
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultUserAgent is sent with requests by clients without a UserAgent.
+const DefaultUserAgent = "alicloudapislim/" + Version
+
+// DefaultMaxResponseBytes is the size limit of response bodies used by clients
+// without a MaxResponseBytes.
+const DefaultMaxResponseBytes = 10 << 20
+
+const defaultConcurrency = 5
+
+// Config holds the settings shared by MarketClient and WuliuClient.
+type Config struct {
+	HTTPClient       *http.Client // defaults to http.DefaultClient
+	Endpoint         string       // base URL, defaults to the Alicloud endpoint
+	UserAgent        string
+	Retry            RetryPolicy
+	MaxResponseBytes int64
+
+	// DefaultTimeout limits each call, including its retries, when the
+	// context passed to it has no deadline and no more specific timeout of
+	// the client applies. Deadlines of the context always take precedence.
+	DefaultTimeout time.Duration
+
+	// Logger logs every request sent, including retries, if set.
+	Logger *log.Logger
+
+	// OnRequest is called before every request is sent, including retries.
+	OnRequest func(RequestInfo)
+
+	// Headers are added to every request, except those the request already
+	// has, like the Authorization of the Wuliu API. Use UserAgent to change
+	// the User-Agent.
+	Headers http.Header
+
+	// RequestMutator is called with every request just before it is sent,
+	// after the authentication headers are set, for example to add headers
+	// required by a gateway. Changing the query of signed Market requests
+	// invalidates the signature.
+	RequestMutator func(*http.Request)
+
+	// Debug logs details useful to debug SignatureDoesNotMatch errors, like
+	// the canonical query string and the string to sign, to Logger or the
+	// standard logger. The secret is never logged, and AccessKeyId and
+	// SecurityToken are redacted.
+	Debug bool
+
+	// StrictDecoding fails decoding JSON responses with fields unknown to this
+	// package, to notice changes of the apis early. It is noisy, as the
+	// responses have many fields not used.
+	StrictDecoding bool
+
+	// RateLimiter limits the requests sent, including retries, if set.
+	RateLimiter *RateLimiter
+
+	// CorrelationHeader sends the correlation id of the context, see
+	// WithCorrelationID, in this header if set.
+	CorrelationHeader string
+
+	debug *debugRing
+	clock func() time.Time // time.Now if nil, replaced in tests
+}
+
+func (config Config) now() time.Time {
+	if config.clock != nil {
+		return config.clock()
+	}
+	return time.Now()
+}
+
+func (config Config) debugf(format string, v ...interface{}) {
+	if !config.Debug {
+		return
+	}
+	if config.Logger != nil {
+		config.Logger.Printf(format, v...)
+	} else {
+		log.Printf(format, v...)
+	}
+}
+
+type RequestInfo struct {
+	Method        string
+	URL           string // with credentials and signature redacted
+	Attempt       int    // 1 for the first attempt
+	CorrelationID string
+}
+
+type correlationIDKey struct{}
+
+// WithCorrelationID returns a context tagging requests made with it with id
+// in logs, OnRequest and CorrelationHeader.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+func CorrelationIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey{}).(string)
+	return id
+}
+
+func (config Config) userAgent() string {
+	if config.UserAgent != "" {
+		return config.UserAgent
+	}
+	return DefaultUserAgent
+}
+
+func (config Config) endpoint(defaultEndpoint string) string {
+	if config.Endpoint != "" {
+		return strings.TrimSuffix(config.Endpoint, "/")
+	}
+	return defaultEndpoint
+}
+
+// withTimeout adds timeout, or DefaultTimeout if it is zero, to ctx if ctx has
+// no deadline yet.
+func (config Config) withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	if timeout == 0 {
+		timeout = config.DefaultTimeout
+	}
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (config Config) httpClient() *http.Client {
+	if config.HTTPClient != nil {
+		return config.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// do sends the request built by newRequest, building a new one for each retry.
+func (config Config) do(ctx context.Context, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	budget := retryBudgetFromContext(ctx)
+	start := config.now()
+	backoff := config.Retry.Backoff
+	for attempt := 0; ; attempt++ {
+		if err := config.RateLimiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range config.Headers {
+			key = http.CanonicalHeaderKey(key)
+			if _, ok := req.Header[key]; !ok {
+				req.Header[key] = append([]string(nil), values...)
+			}
+		}
+		req.Header.Set("User-Agent", config.userAgent())
+		correlationID := CorrelationIDFromContext(ctx)
+		if correlationID != "" && config.CorrelationHeader != "" {
+			req.Header.Set(config.CorrelationHeader, correlationID)
+		}
+		if config.RequestMutator != nil {
+			config.RequestMutator(req)
+		}
+		if config.Logger != nil || config.OnRequest != nil {
+			info := RequestInfo{
+				Method:        req.Method,
+				URL:           redactURL(req.URL),
+				Attempt:       attempt + 1,
+				CorrelationID: correlationID,
+			}
+			if config.Logger != nil {
+				config.Logger.Printf("[%s] %s %s (attempt %d)", info.CorrelationID, info.Method, info.URL, info.Attempt)
+			}
+			if config.OnRequest != nil {
+				config.OnRequest(info)
+			}
+		}
+		resp, err := config.httpClient().Do(req)
+		if config.debug != nil {
+			config.debug.capture(config.now(), req, resp, err, config.maxResponseBytes())
+		}
+		if attempt >= config.Retry.MaxRetries || !config.Retry.retryable(ctx, resp, err) {
+			return resp, err
+		}
+		delay := config.Retry.delay(backoff)
+		if resp != nil {
+			if d, ok := parseRetryAfter(resp.Header.Get("Retry-After"), config.now()); ok {
+				delay = d
+			}
+		}
+		if config.Retry.MaxElapsedTime > 0 && config.now().Sub(start)+delay > config.Retry.MaxElapsedTime {
+			return resp, err
+		}
+		if !budget.take() {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if err := sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+		backoff = config.Retry.next(backoff)
+	}
+}
+
+func (config Config) maxResponseBytes() int64 {
+	if config.MaxResponseBytes > 0 {
+		return config.MaxResponseBytes
+	}
+	return DefaultMaxResponseBytes
+}
+
+// readBody reads the whole response body, decompressing it if needed, failing
+// if it is larger than MaxResponseBytes.
+func (config Config) readBody(resp *http.Response) ([]byte, error) {
+	max := config.maxResponseBytes()
+	var reader io.Reader = resp.Body
+	// http.Transport decompresses gzip itself and removes the header when it
+	// asked for it, so it is only seen when a proxy or a custom transport
+	// compresses the body anyway
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	body, err := io.ReadAll(io.LimitReader(reader, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > max {
+		return nil, fmt.Errorf("response body exceeds %d bytes", max)
+	}
+	// some CDNs in front of the gateway prepend a UTF-8 BOM or whitespace
+	body = bytes.TrimLeft(bytes.TrimPrefix(body, []byte("\xef\xbb\xbf")), " \t\r\n")
+	return body, nil
+}
+
+func (config Config) decode(resp *http.Response, target interface{}) error {
+	body, err := config.readBody(resp)
+	if err != nil {
+		return err
+	}
+	if !config.StrictDecoding {
+		return json.Unmarshal(body, target)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(target)
+}
+
+func (config Config) decodeXML(resp *http.Response, target interface{}) error {
+	body, err := config.readBody(resp)
+	if err != nil {
+		return err
+	}
+	return xml.Unmarshal(body, target)
+}
+
+// flexInt is an integer decoded from either a JSON number or a JSON string of
+// a number, as some gateways return numbers as strings. Empty and "null"
+// strings are 0.
+type flexInt int64
+
+func (n *flexInt) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		data = []byte(strings.TrimSpace(s))
+		if len(data) == 0 || string(data) == "null" {
+			*n = 0
+			return nil
+		}
+	}
+	i, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid integer %s", data)
+	}
+	*n = flexInt(i)
+	return nil
+}
+
+func shouldRetry(ctx context.Context, resp *http.Response, err error) bool {
+	if err != nil {
+		return ctx.Err() == nil
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// TunedHTTPClientOptions configures NewTunedHTTPClient, zero values use the
+// defaults in brackets.
+type TunedHTTPClientOptions struct {
+	Timeout             time.Duration // whole request (30s)
+	DialTimeout         time.Duration // (5s)
+	TLSHandshakeTimeout time.Duration // (5s)
+	IdleConnTimeout     time.Duration // (90s)
+	MaxIdleConns        int           // (100)
+	MaxIdleConnsPerHost int           // (20)
+}
+
+// NewTunedHTTPClient returns an http.Client for Config.HTTPClient suited to
+// many concurrent requests. Each client only talks to one host (e.g.
+// market.aliyuncs.com or wuliu.market.alicloudapi.com), so MaxIdleConnsPerHost
+// should be about the number of concurrent requests, instead of the default
+// of 2 of http.DefaultTransport which closes connections under load.
+func NewTunedHTTPClient(opts TunedHTTPClientOptions) *http.Client {
+	if opts.Timeout == 0 {
+		opts.Timeout = 30 * time.Second
+	}
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = 5 * time.Second
+	}
+	if opts.TLSHandshakeTimeout == 0 {
+		opts.TLSHandshakeTimeout = 5 * time.Second
+	}
+	if opts.IdleConnTimeout == 0 {
+		opts.IdleConnTimeout = 90 * time.Second
+	}
+	if opts.MaxIdleConns == 0 {
+		opts.MaxIdleConns = 100
+	}
+	if opts.MaxIdleConnsPerHost == 0 {
+		opts.MaxIdleConnsPerHost = 20
+	}
+	dialer := &net.Dialer{
+		Timeout:   opts.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Client{
+		Timeout: opts.Timeout,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         dialer.DialContext,
+			ForceAttemptHTTP2:   true,
+			TLSHandshakeTimeout: opts.TLSHandshakeTimeout,
+			IdleConnTimeout:     opts.IdleConnTimeout,
+			MaxIdleConns:        opts.MaxIdleConns,
+			MaxIdleConnsPerHost: opts.MaxIdleConnsPerHost,
+		},
+	}
+}
+
+var ErrClosed = errors.New("client is closed")
+
+// closer tracks whether a client is closed and signals its background work
+// to stop.
+type closer struct {
+	mu     sync.Mutex
+	closed bool
+	done   chan struct{}
+}
+
+func (c *closer) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		if c.done != nil {
+			close(c.done)
+		}
+	}
+	return nil
+}
+
+func (c *closer) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// context returns a context cancelled when the client is closed, for work in
+// the background outliving the context of any caller.
+func (c *closer) context() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := c.doneChan()
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// doneChan returns a channel closed when the client is closed.
+func (c *closer) doneChan() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done == nil {
+		c.done = make(chan struct{})
+		if c.closed {
+			close(c.done)
+		}
+	}
+	return c.done
+}
+
+// forEach calls fn with 0 to n-1, running at most limit calls at a time.
+func forEach(n, limit int, fn func(i int)) {
+	if limit <= 0 {
+		limit = defaultConcurrency
+	}
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,77 @@
+package alicloudapislim
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Commodity is the Commodity parameter of DescribePrice and CreateOrder.
+// Components are left out when empty, like for renewals, which keep the
+// package of the instance. The fields are encoded in the order below for both
+// actions, so DescribePrice sends quantity before instanceId, which the api
+// does not care about. CreateOrder always sets the fields left out when zero.
+type Commodity struct {
+	Components   map[string]string `json:"components,omitempty"`
+	SkuCode      string            `json:"skuCode,omitempty"`
+	Duration     int               `json:"duration,omitempty"`
+	PricingCycle string            `json:"pricingCycle,omitempty"`
+	ProductCode  string            `json:"productCode"`
+	Quantity     int               `json:"quantity,omitempty"`
+	InstanceId   string            `json:"instanceId,omitempty"`
+}
+
+type CommodityOption func(*Commodity)
+
+// CommodityProductCode sets the product code, which is required.
+func CommodityProductCode(code string) CommodityOption {
+	return func(c *Commodity) { c.ProductCode = code }
+}
+
+func CommoditySkuCode(skuCode string) CommodityOption {
+	return func(c *Commodity) { c.SkuCode = skuCode }
+}
+
+// CommodityDuration sets the duration of CycleMonth or CycleYear.
+func CommodityDuration(duration int, cycle string) CommodityOption {
+	return func(c *Commodity) {
+		c.Duration = duration
+		c.PricingCycle = cycle
+	}
+}
+
+func CommodityQuantity(quantity int) CommodityOption {
+	return func(c *Commodity) { c.Quantity = quantity }
+}
+
+func CommodityInstanceId(instanceId string) CommodityOption {
+	return func(c *Commodity) { c.InstanceId = instanceId }
+}
+
+// BuildCommodity returns the Commodity JSON of components, like
+// {"package_version": "basic"}, for the Commodity of PriceOptions and
+// CreateOrderOptions, to order products needing more than the one component
+// built from the option.
+func BuildCommodity(components map[string]string, opts ...CommodityOption) ([]byte, error) {
+	c := Commodity{Components: components}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c.Marshal()
+}
+
+// Marshal returns the JSON of the commodity, failing without a ProductCode or
+// with an invalid Quantity or PricingCycle. A Quantity of 0 is left out for
+// the default of the server, which is 1.
+func (c Commodity) Marshal() ([]byte, error) {
+	if c.ProductCode == "" {
+		return nil, errors.New("product code is required")
+	}
+	if c.Quantity < 0 {
+		return nil, fmt.Errorf("invalid quantity %d: must be at least 1, or 0 for the default of 1", c.Quantity)
+	}
+	if c.PricingCycle != "" && c.PricingCycle != CycleMonth && c.PricingCycle != CycleYear {
+		return nil, fmt.Errorf("invalid cycle %q: must be %s or %s", c.PricingCycle, CycleMonth, CycleYear)
+	}
+	return json.Marshal(c)
+}
@@ -0,0 +1,97 @@
+package alicloudapislim
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+type DebugEntry struct {
+	Time       time.Time
+	URL        string // with credentials and signature redacted
+	StatusCode int
+	Body       []byte // raw response body
+	Err        error
+}
+
+// redactedParams are query parameters replaced in captured URLs.
+var redactedParams = []string{"AccessKeyId", "Signature", "SecurityToken"}
+
+type debugRing struct {
+	mu      sync.Mutex
+	entries []DebugEntry
+	next    int
+	full    bool
+}
+
+// EnableDebugCapture keeps the last n requests and their responses, see
+// LastRequests. Use 0 to stop capturing.
+func (config *Config) EnableDebugCapture(n int) {
+	if n <= 0 {
+		config.debug = nil
+		return
+	}
+	config.debug = &debugRing{entries: make([]DebugEntry, n)}
+}
+
+// LastRequests returns the captured requests, oldest first.
+func (config *Config) LastRequests() []DebugEntry {
+	ring := config.debug
+	if ring == nil {
+		return nil
+	}
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	entries := []DebugEntry{}
+	if ring.full {
+		entries = append(entries, ring.entries[ring.next:]...)
+	}
+	return append(entries, ring.entries[:ring.next]...)
+}
+
+// capture records the request and response, replacing the response body with
+// a copy of it.
+func (ring *debugRing) capture(now time.Time, req *http.Request, resp *http.Response, err error, max int64) {
+	entry := DebugEntry{
+		Time: now,
+		URL:  redactURL(req.URL),
+		Err:  err,
+	}
+	if resp != nil {
+		entry.StatusCode = resp.StatusCode
+		entry.Body, _ = io.ReadAll(io.LimitReader(resp.Body, max+1))
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(entry.Body))
+	}
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	ring.entries[ring.next] = entry
+	ring.next++
+	if ring.next == len(ring.entries) {
+		ring.next = 0
+		ring.full = true
+	}
+}
+
+func redactURL(u *url.URL) string {
+	redacted := *u
+	redacted.RawQuery = redactParams(redacted.Query()).Encode()
+	return redacted.String()
+}
+
+// redactParams returns a copy of params with redactedParams replaced.
+func redactParams(params url.Values) url.Values {
+	redacted := url.Values{}
+	for key, values := range params {
+		redacted[key] = append([]string(nil), values...)
+	}
+	for _, key := range redactedParams {
+		if redacted.Has(key) {
+			redacted.Set(key, "REDACTED")
+		}
+	}
+	return redacted
+}
@@ -5,18 +5,114 @@ import (
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"net/url"
+	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+const DefaultMarketEndpoint = "https://market.aliyuncs.com"
+
+const (
+	FormatJSON = "json"
+	FormatXML  = "xml"
+)
+
+// maxClockSkew is how far the local clock can drift from the server clock
+// before CorrectClockSkew considers it the cause of an error.
+const maxClockSkew = time.Minute
+
+const (
+	MinNonceLength = 16
+	MaxNonceLength = 64 // the longest SignatureNonce and ClientToken accepted
+)
+
 type MarketClient struct {
+	Config
+
+	// NonceLength is the length of generated SignatureNonce and ClientToken
+	// values, from MinNonceLength to MaxNonceLength, defaults to 64.
+	NonceLength int
+
+	// Format of the responses, FormatJSON (default) or FormatXML for actions
+	// which only return sensible data as XML.
+	Format string
+
+	// RandStringFunc generates the random SignatureNonce and ClientToken
+	// values of length n, defaults to an unbiased crypto/rand generator of
+	// letters and digits. Tests can pin the values with it.
+	RandStringFunc func(n int) (string, error)
+
+	// PageSize is the page size requested by list actions like GetProducts,
+	// 0 for the default of the server.
+	PageSize int
+
+	// MaxPages caps the number of pages fetched by GetProducts and the like,
+	// 0 for all pages. The products returned are then partial; compare
+	// TotalCount of GetProductList to tell.
+	MaxPages int
+
+	// PartialProducts makes GetProducts and GetProductList return the
+	// products of the pages fetched along with the error when other pages
+	// fail, instead of no products. Failing to fetch the first page still
+	// returns no products.
+	PartialProducts bool
+
+	// SecurityToken is sent with every request when set, for temporary STS
+	// credentials.
+	SecurityToken string
+
+	// OwnerId is sent with every request when set, to act on the market
+	// instances of another account, e.g. in RAM or multi-tenant setups.
+	OwnerId string
+
+	// RegionId is sent with every request when set, for region-scoped actions.
+	RegionId string
+
+	// CurrencyConverter converts prices returned by GetPrice from the currency
+	// of the api, for example to a single currency for comparisons. Price and
+	// PriceMinor are then in the converted currency while Currency still is
+	// the one of the api.
+	CurrencyConverter func(amount float64, from string) (float64, error)
+
+	// SignFunc replaces the in-process HMAC-SHA1 signing with the secret, for
+	// keys kept in an HSM or KMS. It must return the base64 encoded HMAC-SHA1
+	// of stringToSign keyed with the secret followed by "&".
+	SignFunc func(stringToSign string) (signature string, err error)
+
+	// OrderTimeout and ReadTimeout override DefaultTimeout for CreateOrder
+	// and for all other actions respectively.
+	OrderTimeout time.Duration
+	ReadTimeout  time.Duration
+
+	// TimeOffset is added to the local clock when signing requests.
+	TimeOffset time.Duration
+
+	// CorrectClockSkew retries a request rejected because of its timestamp
+	// once, with the clock offset detected from the Date header of the
+	// response. The offset is kept for later requests, see ClockOffset.
+	CorrectClockSkew bool
+
+	// ProductCacheTTL caches the catalogs of GetFullProduct for this long, 0
+	// disables caching.
+	ProductCacheTTL time.Duration
+
+	mu          sync.Mutex
+	clockOffset time.Duration
+	catalogs    map[string]cachedCatalog
+	closer      closer
+
 	accessKeyId     string
 	accessKeySecret string
 }
@@ -29,11 +125,41 @@ type MarketProduct struct {
 	Unit      string
 }
 
+// RemainingPercent returns the share of the quota not used yet, from 0 to 100.
+func (product MarketProduct) RemainingPercent() float64 {
+	total := product.Remaining + product.Used
+	if total <= 0 {
+		return 0
+	}
+	return float64(product.Remaining) / float64(total) * 100
+}
+
 type MarketProductDetails struct {
 	Id          string
 	Name        string
 	Description string
+	Type        string // e.g. ProductTypeAPI
 	Options     []MarketProductOption
+	Modules     []MarketProductModule
+}
+
+const ProductTypeAPI = "API"
+
+type MarketProductModule struct {
+	Code       string
+	ChargeType string // of the sku the module belongs to
+	Properties []MarketProductProperty
+}
+
+type MarketProductProperty struct {
+	Key    string
+	Values []MarketProductPropertyValue
+}
+
+type MarketProductPropertyValue struct {
+	Type  string
+	Name  string
+	Value string
 }
 
 type MarketProductOption struct {
@@ -47,40 +173,168 @@ type MarketProductOptionWithPrice struct {
 	Duration int
 	Cycle    string
 	Price    string
+	Currency string // currency returned by the api, e.g. CNY
+
+	OriginalPrice string // list price before discounts
+	DiscountPrice string // amount of discounts
+
+	PriceMinor         int64 // price in minor units of the currency (cents)
+	OriginalPriceMinor int64
+}
+
+// DiscountPercent returns how much cheaper Price is than OriginalPrice, from 0
+// to 100, or 0 without an OriginalPrice.
+func (option MarketProductOptionWithPrice) DiscountPercent() float64 {
+	if option.OriginalPriceMinor <= 0 || option.PriceMinor >= option.OriginalPriceMinor {
+		return 0
+	}
+	return float64(option.OriginalPriceMinor-option.PriceMinor) / float64(option.OriginalPriceMinor) * 100
+}
+
+// TotalMonths returns the subscription length of Duration in months, for
+// example 12 for both 12 of CycleMonth and 1 of CycleYear, or 0 if Cycle is
+// unknown.
+func (option MarketProductOptionWithPrice) TotalMonths() int {
+	switch option.Cycle {
+	case CycleMonth:
+		return option.Duration
+	case CycleYear:
+		return option.Duration * 12
+	}
+	return 0
+}
+
+const (
+	EnvAccessKeyId     = "ALIYUN_ACCESS_KEY_ID"
+	EnvAccessKeySecret = "ALIYUN_ACCESS_KEY_SECRET"
+	EnvSecurityToken   = "ALIYUN_SECURITY_TOKEN" // optional
+	EnvRegionId        = "ALIYUN_REGION_ID"      // optional
+)
+
+// NewMarketClientFromEnv creates a client with the credentials in the
+// ALIYUN_ACCESS_KEY_ID and ALIYUN_ACCESS_KEY_SECRET environment variables, and
+// the SecurityToken and RegionId in ALIYUN_SECURITY_TOKEN and ALIYUN_REGION_ID
+// if set.
+func NewMarketClientFromEnv(opts ...Option) (*MarketClient, error) {
+	accessKeyId := os.Getenv(EnvAccessKeyId)
+	accessKeySecret := os.Getenv(EnvAccessKeySecret)
+	if accessKeyId == "" {
+		return nil, fmt.Errorf("environment variable %s is not set", EnvAccessKeyId)
+	}
+	if accessKeySecret == "" {
+		return nil, fmt.Errorf("environment variable %s is not set", EnvAccessKeySecret)
+	}
+	client := NewMarketClient(accessKeyId, accessKeySecret, opts...)
+	client.SecurityToken = os.Getenv(EnvSecurityToken)
+	client.RegionId = os.Getenv(EnvRegionId)
+	return client, nil
 }
 
-func NewMarketClient(accessKeyId, accessKeySecret string) *MarketClient {
-	return &MarketClient{
+func NewMarketClient(accessKeyId, accessKeySecret string, opts ...Option) *MarketClient {
+	client := &MarketClient{
 		accessKeyId:     accessKeyId,
 		accessKeySecret: accessKeySecret,
 	}
+	client.apply(opts)
+	return client
+}
+
+type MarketProductList struct {
+	Products     []MarketProduct
+	TotalCount   int
+	PagesFetched int
+
+	// PageSize and PageNumbers are what the server reported for the pages
+	// fetched, which may differ from the PageSize requested, to debug
+	// pagination.
+	PageSize    int
+	PageNumbers []int
+}
+
+func (client *MarketClient) GetProducts(ctx context.Context) ([]MarketProduct, error) {
+	list, err := client.GetProductList(ctx)
+	if list == nil {
+		return nil, err
+	}
+	return list.Products, err
 }
 
-func (client MarketClient) GetProducts(ctx context.Context) ([]MarketProduct, error) {
-	return client.getProducts(ctx, 1)
+// GetProductList is like GetProducts but also returns how many products and
+// pages the server reported, to verify the list is complete.
+func (client *MarketClient) GetProductList(ctx context.Context) (*MarketProductList, error) {
+	params := url.Values{}
+	params.Set("Action", "DescribeApiMetering")
+	params.Set("type", "1")
+	p := pagination{
+		numberKey: "pageNum",
+		sizeKey:   "pageSize",
+		pageSize:  client.PageSize,
+		maxPages:  client.MaxPages,
+		partial:   client.PartialProducts,
+	}
+	pages, err := paginate(ctx, p, params, client.getProducts)
+	if pages == nil {
+		return nil, err
+	}
+	return &MarketProductList{
+		Products:     pages.items,
+		TotalCount:   pages.count,
+		PagesFetched: pages.fetched,
+		PageSize:     pages.size,
+		PageNumbers:  pages.numbers,
+	}, err
 }
 
-func (client MarketClient) getProducts(ctx context.Context, pageNum int) ([]MarketProduct, error) {
+// GetProductMetering returns the metering of the product of productCode, or
+// ErrProductNotFound. The metering is filtered by the server and the pages
+// are scanned until the product is found.
+func (client *MarketClient) GetProductMetering(ctx context.Context, productCode string) (*MarketProduct, error) {
 	params := url.Values{}
+	params.Set("ProductCode", productCode)
+	products, found, err := client.getProductsUntil(ctx, params, func(product MarketProduct) bool {
+		return product.Id == productCode
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrProductNotFound
+	}
+	return &products[len(products)-1], nil
+}
+
+// GetProductsUntil fetches the pages of products one by one until stop
+// returns true for a product, returning the products up to and including it,
+// or all products if it never does.
+func (client *MarketClient) GetProductsUntil(ctx context.Context, stop func(MarketProduct) bool) ([]MarketProduct, error) {
+	products, _, err := client.getProductsUntil(ctx, url.Values{}, stop)
+	return products, err
+}
+
+func (client *MarketClient) getProductsUntil(ctx context.Context, params url.Values, stop func(MarketProduct) bool) ([]MarketProduct, bool, error) {
 	params.Set("Action", "DescribeApiMetering")
 	params.Set("type", "1")
-	params.Set("pageNum", strconv.Itoa(pageNum))
+	p := pagination{numberKey: "pageNum", sizeKey: "pageSize", pageSize: client.PageSize, maxPages: client.MaxPages}
+	return paginateUntil(ctx, p, params, client.getProducts, stop)
+}
+
+func (client *MarketClient) getProducts(ctx context.Context, params url.Values) (*marketPage[MarketProduct], error) {
 	var resp struct {
-		PageSize   int    `json:"PageSize"`
-		Message    string `json:"Message"`
-		PageNumber int    `json:"PageNumber"`
-		Version    string `json:"Version"`
-		Count      int    `json:"Count"`
-		Fatal      bool   `json:"Fatal"`
-		Code       string `json:"Code"`
-		Success    bool   `json:"Success"`
+		PageSize   flexInt `json:"PageSize"`
+		Message    string  `json:"Message"`
+		PageNumber flexInt `json:"PageNumber"`
+		Version    string  `json:"Version"`
+		Count      flexInt `json:"Count"`
+		Fatal      bool    `json:"Fatal"`
+		Code       string  `json:"Code"`
+		Success    bool    `json:"Success"`
 		Result     []struct {
-			ProductName string `json:"ProductName"`
-			AliyunPk    int64  `json:"AliyunPk"`
-			ProductCode string `json:"ProductCode"`
-			TotalQuota  int    `json:"TotalQuota"`
-			TotalUsage  int    `json:"TotalUsage"`
-			Unit        string `json:"Unit"`
+			ProductName string  `json:"ProductName"`
+			AliyunPk    flexInt `json:"AliyunPk"`
+			ProductCode string  `json:"ProductCode"`
+			TotalQuota  flexInt `json:"TotalQuota"`
+			TotalUsage  flexInt `json:"TotalUsage"`
+			Unit        string  `json:"Unit"`
 		} `json:"Result"`
 	}
 	err := client.request(ctx, params, &resp)
@@ -88,30 +342,330 @@ func (client MarketClient) getProducts(ctx context.Context, pageNum int) ([]Mark
 		return nil, err
 	}
 	if !resp.Success {
-		return nil, fmt.Errorf("failed to get metering info: code %s, message %s returned", resp.Code, resp.Message)
+		return nil, fmt.Errorf("failed to get metering info: %w", &MarketError{
+			StatusCode: 200,
+			Code:       resp.Code,
+			Message:    resp.Message,
+		})
 	}
 	products := []MarketProduct{}
 	for _, item := range resp.Result {
 		products = append(products, MarketProduct{
 			Id:        item.ProductCode,
 			Name:      item.ProductName,
-			Remaining: item.TotalQuota,
-			Used:      item.TotalUsage,
+			Remaining: int(item.TotalQuota),
+			Used:      int(item.TotalUsage),
 			Unit:      item.Unit,
 		})
 	}
-	totalPages := int(resp.Count / resp.PageSize)
-	for i := 2; i <= totalPages; i++ {
-		prods, err := client.getProducts(ctx, i)
+	return &marketPage[MarketProduct]{
+		items:  products,
+		count:  int(resp.Count),
+		size:   int(resp.PageSize),
+		number: int(resp.PageNumber),
+	}, nil
+}
+
+type MarketInstance struct {
+	Id          string
+	ProductCode string
+	ProductName string
+	SkuCode     string
+	Status      string
+	CreatedAt   time.Time
+	BeganAt     time.Time
+	ExpiredAt   time.Time // zero for instances that never expire
+}
+
+func (client *MarketClient) ListInstances(ctx context.Context) ([]MarketInstance, error) {
+	params := url.Values{}
+	params.Set("Action", "DescribeInstances")
+	p := pagination{numberKey: "PageNumber", sizeKey: "PageSize", pageSize: client.PageSize}
+	pages, err := paginate(ctx, p, params, client.listInstances)
+	if err != nil {
+		return nil, err
+	}
+	return pages.items, nil
+}
+
+// WillExpireBefore reports whether the instance expires before t. Instances
+// that never expire, like postpaid ones, never do.
+func (instance MarketInstance) WillExpireBefore(t time.Time) bool {
+	return !instance.ExpiredAt.IsZero() && instance.ExpiredAt.Before(t)
+}
+
+// ExpiringBefore returns the instances that expire before t.
+func (client *MarketClient) ExpiringBefore(ctx context.Context, t time.Time) ([]MarketInstance, error) {
+	instances, err := client.ListInstances(ctx)
+	if err != nil {
+		return nil, err
+	}
+	expiring := []MarketInstance{}
+	for _, instance := range instances {
+		if instance.WillExpireBefore(t) {
+			expiring = append(expiring, instance)
+		}
+	}
+	return expiring, nil
+}
+
+type marketInstanceItem struct {
+	InstanceId     int64  `json:"InstanceId"`
+	ProductCode    string `json:"ProductCode"`
+	ProductName    string `json:"ProductName"`
+	ProductSkuCode string `json:"ProductSkuCode"`
+	Status         string `json:"Status"`
+	CreatedOn      int64  `json:"CreatedOn"`
+	BeganOn        int64  `json:"BeganOn"`
+	EndOn          int64  `json:"EndOn"`
+}
+
+func (item marketInstanceItem) instance() MarketInstance {
+	return MarketInstance{
+		Id:          strconv.FormatInt(item.InstanceId, 10),
+		ProductCode: item.ProductCode,
+		ProductName: item.ProductName,
+		SkuCode:     item.ProductSkuCode,
+		Status:      item.Status,
+		CreatedAt:   fromMillis(item.CreatedOn),
+		BeganAt:     fromMillis(item.BeganOn),
+		ExpiredAt:   fromMillis(item.EndOn),
+	}
+}
+
+func (client *MarketClient) listInstances(ctx context.Context, params url.Values) (*marketPage[MarketInstance], error) {
+	var resp struct {
+		PageNumber    flexInt `json:"PageNumber"`
+		PageSize      flexInt `json:"PageSize"`
+		TotalCount    flexInt `json:"TotalCount"`
+		InstanceItems struct {
+			InstanceItem []marketInstanceItem `json:"InstanceItem"`
+		} `json:"InstanceItems"`
+	}
+	err := client.request(ctx, params, &resp)
+	if err != nil {
+		return nil, err
+	}
+	instances := []MarketInstance{}
+	for _, item := range resp.InstanceItems.InstanceItem {
+		instances = append(instances, item.instance())
+	}
+	return &marketPage[MarketInstance]{
+		items:  instances,
+		count:  int(resp.TotalCount),
+		size:   int(resp.PageSize),
+		number: int(resp.PageNumber),
+	}, nil
+}
+
+func (client *MarketClient) GetInstance(ctx context.Context, instanceId string) (*MarketInstance, error) {
+	params := url.Values{}
+	params.Set("Action", "DescribeInstance")
+	params.Set("InstanceId", instanceId)
+	var resp marketInstanceItem
+	if err := client.request(ctx, params, &resp); err != nil {
+		return nil, err
+	}
+	instance := resp.instance()
+	return &instance, nil
+}
+
+type MarketOrder struct {
+	Id          string
+	ProductCode string
+	ProductName string
+	OrderType   string
+	Status      string
+	Amount      string // paid amount
+	CreatedAt   time.Time
+	PaidAt      time.Time
+	InstanceIds []string
+}
+
+type ListOrdersOptions struct {
+	CreatedAfter  time.Time // zero for no limit
+	CreatedBefore time.Time // zero for no limit
+	Status        string    // e.g. PAID or NOPAID, empty for all
+}
+
+func (client *MarketClient) ListOrders(ctx context.Context, opts ListOrdersOptions) ([]MarketOrder, error) {
+	params := url.Values{}
+	params.Set("Action", "DescribeOrders")
+	if !opts.CreatedAfter.IsZero() {
+		params.Set("CreatedOnStart", strconv.FormatInt(opts.CreatedAfter.UnixMilli(), 10))
+	}
+	if !opts.CreatedBefore.IsZero() {
+		params.Set("CreatedOnEnd", strconv.FormatInt(opts.CreatedBefore.UnixMilli(), 10))
+	}
+	if opts.Status != "" {
+		params.Set("OrderStatus", opts.Status)
+	}
+	p := pagination{numberKey: "PageNumber", sizeKey: "PageSize", pageSize: client.PageSize}
+	pages, err := paginate(ctx, p, params, client.listOrders)
+	if err != nil {
+		return nil, err
+	}
+	return pages.items, nil
+}
+
+type marketOrderItem struct {
+	OrderId      int64   `json:"OrderId"`
+	ProductCode  string  `json:"ProductCode"`
+	ProductName  string  `json:"ProductName"`
+	OrderType    string  `json:"OrderType"`
+	OrderStatus  string  `json:"OrderStatus"`
+	PaymentPrice float64 `json:"PaymentPrice"`
+	CreatedOn    int64   `json:"CreatedOn"`
+	PaidOn       int64   `json:"PaidOn"`
+	InstanceIds  struct {
+		InstanceId []string `json:"InstanceId"`
+	} `json:"InstanceIds"`
+}
+
+func (item marketOrderItem) order() MarketOrder {
+	return MarketOrder{
+		Id:          strconv.FormatInt(item.OrderId, 10),
+		ProductCode: item.ProductCode,
+		ProductName: item.ProductName,
+		OrderType:   item.OrderType,
+		Status:      item.OrderStatus,
+		Amount:      fmt.Sprintf("%.2f", item.PaymentPrice),
+		CreatedAt:   fromMillis(item.CreatedOn),
+		PaidAt:      fromMillis(item.PaidOn),
+		InstanceIds: item.InstanceIds.InstanceId,
+	}
+}
+
+func (client *MarketClient) listOrders(ctx context.Context, params url.Values) (*marketPage[MarketOrder], error) {
+	var resp struct {
+		PageNumber flexInt `json:"PageNumber"`
+		PageSize   flexInt `json:"PageSize"`
+		TotalCount flexInt `json:"TotalCount"`
+		OrderList  struct {
+			Order []marketOrderItem `json:"Order"`
+		} `json:"OrderList"`
+	}
+	err := client.request(ctx, params, &resp)
+	if err != nil {
+		return nil, err
+	}
+	orders := []MarketOrder{}
+	for _, item := range resp.OrderList.Order {
+		orders = append(orders, item.order())
+	}
+	return &marketPage[MarketOrder]{
+		items:  orders,
+		count:  int(resp.TotalCount),
+		size:   int(resp.PageSize),
+		number: int(resp.PageNumber),
+	}, nil
+}
+
+func (client *MarketClient) GetOrder(ctx context.Context, orderId string) (*MarketOrder, error) {
+	params := url.Values{}
+	params.Set("Action", "DescribeOrder")
+	params.Set("OrderId", orderId)
+	var resp marketOrderItem
+	if err := client.request(ctx, params, &resp); err != nil {
+		return nil, err
+	}
+	order := resp.order()
+	return &order, nil
+}
+
+const InstanceStatusNormal = "NORMAL"
+
+type WaitOptions struct {
+	PollInterval time.Duration // defaults to 5 seconds
+	Timeout      time.Duration // 0 to only wait until ctx is done
+}
+
+// PurchaseAndWait purchases the option like Purchase, then polls the order
+// and its instance until the instance is provisioned, returning its id.
+func (client *MarketClient) PurchaseAndWait(ctx context.Context, productCode, optionCode string, opts WaitOptions) (string, error) {
+	result, err := client.Purchase(ctx, productCode, optionCode)
+	if err != nil {
+		return "", err
+	}
+	return client.WaitForActive(ctx, result.OrderId, opts)
+}
+
+// WaitForActive polls the order and its instance until the instance is
+// provisioned, returning its id.
+func (client *MarketClient) WaitForActive(ctx context.Context, orderId string, opts WaitOptions) (string, error) {
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = 5 * time.Second
+	}
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	for {
+		order, err := client.GetOrder(ctx, orderId)
 		if err != nil {
-			return nil, err
+			return "", fmt.Errorf("failed to get order %s: %w", orderId, err)
+		}
+		if len(order.InstanceIds) > 0 {
+			instance, err := client.GetInstance(ctx, order.InstanceIds[0])
+			if err != nil {
+				return "", fmt.Errorf("failed to get instance %s: %w", order.InstanceIds[0], err)
+			}
+			if instance.Status == InstanceStatusNormal {
+				return instance.Id, nil
+			}
+		}
+		if err := sleep(ctx, opts.PollInterval); err != nil {
+			return "", fmt.Errorf("order %s not provisioned: %w", orderId, err)
 		}
-		products = append(products, prods...)
 	}
-	return products, nil
 }
 
-func (client MarketClient) GetProduct(ctx context.Context, id string) (*MarketProductDetails, error) {
+const (
+	OrderStatusUnpaid    = "NOPAID"
+	OrderStatusPaid      = "PAID"
+	OrderStatusCancelled = "CANCELLED"
+)
+
+// WaitForOrderPaid polls the order every interval (5 seconds if 0) until it is
+// paid, like after the payment of a PaymentTypeHand order, returning the paid
+// order. The interval is doubled while GetOrder is throttled.
+func (client *MarketClient) WaitForOrderPaid(ctx context.Context, orderId string, interval time.Duration) (*MarketOrder, error) {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	delay := interval
+	for {
+		order, err := client.GetOrder(ctx, orderId)
+		var marketErr *MarketError
+		switch {
+		case errors.As(err, &marketErr) && marketErr.isThrottling():
+			delay *= 2
+		case err != nil:
+			return nil, fmt.Errorf("failed to get order %s: %w", orderId, err)
+		case order.Status == OrderStatusPaid:
+			return order, nil
+		case order.Status == OrderStatusCancelled:
+			return order, fmt.Errorf("order %s was cancelled", orderId)
+		default:
+			delay = interval
+		}
+		if err := sleep(ctx, delay); err != nil {
+			return nil, fmt.Errorf("order %s not paid: %w", orderId, err)
+		}
+	}
+}
+
+// fromMillis converts milliseconds since the epoch used by the Market API to
+// time, 0 being the zero time.
+func fromMillis(ms int64) time.Time {
+	if ms <= 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+func (client *MarketClient) GetProduct(ctx context.Context, id string) (*MarketProductDetails, error) {
 	params := url.Values{}
 	params.Set("Action", "DescribeProduct")
 	params.Set("Code", id)
@@ -147,9 +701,33 @@ func (client MarketClient) GetProduct(ctx context.Context, id string) (*MarketPr
 	if err != nil {
 		return nil, err
 	}
+	if resp.Code == "" {
+		return nil, fmt.Errorf("%w: %s", ErrProductNotFound, id)
+	}
 	options := []MarketProductOption{}
+	modules := []MarketProductModule{}
 	for _, sku := range resp.ProductSkus.ProductSku {
 		for _, module := range sku.Modules.Module {
+			properties := []MarketProductProperty{}
+			for _, property := range module.Properties.Property {
+				values := []MarketProductPropertyValue{}
+				for _, value := range property.PropertyValues.PropertyValue {
+					values = append(values, MarketProductPropertyValue{
+						Type:  value.Type,
+						Name:  value.DisplayName,
+						Value: value.Value,
+					})
+				}
+				properties = append(properties, MarketProductProperty{
+					Key:    property.Key,
+					Values: values,
+				})
+			}
+			modules = append(modules, MarketProductModule{
+				Code:       module.Code,
+				ChargeType: sku.ChargeType,
+				Properties: properties,
+			})
 			if module.Code == "package_version" {
 				for _, option := range module.Properties.Property {
 					if option.Key == "package_version" {
@@ -168,21 +746,95 @@ func (client MarketClient) GetProduct(ctx context.Context, id string) (*MarketPr
 		Id:          resp.Code,
 		Name:        resp.Name,
 		Description: resp.ShortDescription,
+		Type:        resp.Type,
 		Options:     options,
+		Modules:     modules,
 	}, err
 }
 
-func (client MarketClient) GetPrice(ctx context.Context, id, option string) (*MarketProductOptionWithPrice, error) {
+// GetProductDetails gets the details of the products of codes concurrently,
+// in the order of codes. The details of codes that fail are nil, and the
+// error joins the errors of all of them.
+func (client *MarketClient) GetProductDetails(ctx context.Context, codes ...string) ([]*MarketProductDetails, error) {
+	details := make([]*MarketProductDetails, len(codes))
+	errs := make([]error, len(codes))
+	forEach(len(codes), defaultConcurrency, func(i int) {
+		product, err := client.GetProduct(ctx, codes[i])
+		if err != nil {
+			errs[i] = fmt.Errorf("failed to get product %s: %w", codes[i], err)
+			return
+		}
+		details[i] = product
+	})
+	return details, errors.Join(errs...)
+}
+
+// GetProductsOfType gets the details of the products of codes concurrently,
+// returning those of the given type, like ProductTypeAPI, in the order of
+// codes.
+func (client *MarketClient) GetProductsOfType(ctx context.Context, productType string, codes ...string) ([]MarketProductDetails, error) {
+	details, err := client.GetProductDetails(ctx, codes...)
+	if err != nil {
+		return nil, err
+	}
+	products := []MarketProductDetails{}
+	for _, product := range details {
+		if product.Type == productType {
+			products = append(products, *product)
+		}
+	}
+	return products, nil
+}
+
+type PriceOptions struct {
+	OrderType  string // defaults to OrderTypeBuy
+	InstanceId string // required for OrderTypeRenew and OrderTypeUpgrade
+	Quantity   int    // defaults to the default of the server, usually 1
+
+	// Commodity replaces the Commodity built from the product and option,
+	// see BuildCommodity.
+	Commodity json.RawMessage
+}
+
+func (client *MarketClient) GetPrice(ctx context.Context, id, option string) (*MarketProductOptionWithPrice, error) {
+	return client.GetPriceWithOptions(ctx, id, option, PriceOptions{})
+}
+
+// GetPriceForQuantity gets the total price of qty of the option, including
+// any discounts for the quantity.
+func (client *MarketClient) GetPriceForQuantity(ctx context.Context, id, option string, qty int) (*MarketProductOptionWithPrice, error) {
+	if qty < 1 {
+		return nil, fmt.Errorf("invalid quantity %d: must be at least 1", qty)
+	}
+	return client.GetPriceWithOptions(ctx, id, option, PriceOptions{Quantity: qty})
+}
+
+func (client *MarketClient) GetPriceWithOptions(ctx context.Context, id, option string, opts PriceOptions) (*MarketProductOptionWithPrice, error) {
+	if opts.OrderType == "" {
+		opts.OrderType = OrderTypeBuy
+	}
+	if err := checkInstanceId(opts.OrderType, opts.InstanceId); err != nil {
+		return nil, err
+	}
+	if opts.Quantity < 0 {
+		return nil, fmt.Errorf("invalid quantity %d: must be at least 1", opts.Quantity)
+	}
 	params := url.Values{}
 	params.Set("Action", "DescribePrice")
-	params.Set("OrderType", "INSTANCE_BUY")
-	commodity, _ := json.Marshal(struct {
-		Components  map[string]string `json:"components"`
-		ProductCode string            `json:"productCode"`
-	}{
-		map[string]string{"package_version": option},
-		id,
-	})
+	params.Set("OrderType", opts.OrderType)
+	commodity := opts.Commodity
+	if commodity == nil {
+		var err error
+		commodity, err = Commodity{
+			Components:  map[string]string{"package_version": option},
+			ProductCode: id,
+			InstanceId:  opts.InstanceId,
+			Quantity:    opts.Quantity,
+		}.Marshal()
+		if err != nil {
+			return nil, err
+		}
+	}
 	params.Set("Commodity", string(commodity))
 	var resp struct {
 		ProductCode   string  `json:"ProductCode"`
@@ -197,34 +849,272 @@ func (client MarketClient) GetPrice(ctx context.Context, id, option string) (*Ma
 	if err != nil {
 		return nil, err
 	}
+	price, originalPrice, discountPrice := resp.TradePrice, resp.OriginalPrice, resp.DiscountPrice
+	if client.CurrencyConverter != nil {
+		for _, amount := range []*float64{&price, &originalPrice, &discountPrice} {
+			*amount, err = client.CurrencyConverter(*amount, resp.Currency)
+			if err != nil {
+				return nil, fmt.Errorf("failed to convert price from %s: %w", resp.Currency, err)
+			}
+		}
+	}
+	// the prices and their minor units are rounded once, so they always agree
+	minor := make([]int64, 3)
+	for i, amount := range []float64{price, originalPrice, discountPrice} {
+		if minor[i], err = toMinorUnits(amount); err != nil {
+			return nil, err
+		}
+	}
+	priceMinor, originalPriceMinor, discountPriceMinor := minor[0], minor[1], minor[2]
 	return &MarketProductOptionWithPrice{
-		Id:       id,
-		Code:     option,
-		Duration: resp.Duration,
-		Cycle:    resp.Cycle,
-		Price:    fmt.Sprintf("%.2f", resp.TradePrice),
-	}, err
+		Id:            id,
+		Code:          option,
+		Duration:      resp.Duration,
+		Cycle:         resp.Cycle,
+		Price:         formatMinorUnits(priceMinor),
+		Currency:      resp.Currency,
+		OriginalPrice: formatMinorUnits(originalPriceMinor),
+		DiscountPrice: formatMinorUnits(discountPriceMinor),
+
+		PriceMinor:         priceMinor,
+		OriginalPriceMinor: originalPriceMinor,
+	}, nil
+}
+
+// PriceAllOptions gets the price of every option of the product concurrently,
+// in the order of the options.
+func (client *MarketClient) PriceAllOptions(ctx context.Context, productCode string) ([]MarketProductOptionWithPrice, error) {
+	product, err := client.GetProduct(ctx, productCode)
+	if err != nil {
+		return nil, err
+	}
+	return client.priceOptions(ctx, productCode, product.Options)
+}
+
+type MarketProductCatalog struct {
+	Details *MarketProductDetails
+	Prices  []MarketProductOptionWithPrice // in the order of Details.Options
+}
+
+// GetProductCatalog gets the details of the product and the prices of all its
+// options, which are fetched concurrently.
+func (client *MarketClient) GetProductCatalog(ctx context.Context, productCode string) (*MarketProductCatalog, error) {
+	product, err := client.GetProduct(ctx, productCode)
+	if err != nil {
+		return nil, err
+	}
+	prices, err := client.priceOptions(ctx, productCode, product.Options)
+	if err != nil {
+		return nil, err
+	}
+	return &MarketProductCatalog{
+		Details: product,
+		Prices:  prices,
+	}, nil
 }
 
-func (client MarketClient) CreateOrder(ctx context.Context, option MarketProductOptionWithPrice, overrides ...interface{}) (string, error) {
+type cachedCatalog struct {
+	catalog   *MarketProductCatalog
+	expiresAt time.Time
+}
+
+// GetFullProduct is like GetProductCatalog but caches the catalog for
+// ProductCacheTTL. Cached catalogs are shared and must not be modified.
+func (client *MarketClient) GetFullProduct(ctx context.Context, productCode string) (*MarketProductCatalog, error) {
+	if client.closer.isClosed() {
+		return nil, ErrClosed
+	}
+	if client.ProductCacheTTL <= 0 {
+		return client.GetProductCatalog(ctx, productCode)
+	}
+	client.mu.Lock()
+	cached, ok := client.catalogs[productCode]
+	client.mu.Unlock()
+	if ok && client.now().Before(cached.expiresAt) {
+		return cached.catalog, nil
+	}
+	catalog, err := client.GetProductCatalog(ctx, productCode)
+	if err != nil {
+		return nil, err
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.catalogs == nil {
+		client.catalogs = map[string]cachedCatalog{}
+	}
+	client.catalogs[productCode] = cachedCatalog{catalog, client.now().Add(client.ProductCacheTTL)}
+	return catalog, nil
+}
+
+func (client *MarketClient) priceOptions(ctx context.Context, productCode string, options []MarketProductOption) ([]MarketProductOptionWithPrice, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	prices := make([]MarketProductOptionWithPrice, len(options))
+	var once sync.Once
+	var firstErr error
+	forEach(len(options), defaultConcurrency, func(i int) {
+		price, err := client.GetPrice(ctx, productCode, options[i].Code)
+		if err != nil {
+			once.Do(func() {
+				firstErr = fmt.Errorf("failed to get price of option %s: %w", options[i].Code, err)
+				cancel()
+			})
+			return
+		}
+		prices[i] = *price
+	})
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return prices, nil
+}
+
+// toMinorUnits converts amount to hundredths, rounding half up on its shortest
+// decimal representation so binary floating point errors like 1.005 being
+// 1.00499999 do not affect the result. It fails if the result overflows.
+func toMinorUnits(amount float64) (int64, error) {
+	whole, frac, _ := strings.Cut(strconv.FormatFloat(math.Abs(amount), 'f', -1, 64), ".")
+	frac += "000"
+	minor, err := strconv.ParseInt(whole+frac[:2], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %v: %w", amount, err)
+	}
+	if frac[2] >= '5' {
+		if minor == math.MaxInt64 {
+			return 0, fmt.Errorf("invalid amount %v: out of range", amount)
+		}
+		minor++
+	}
+	if amount < 0 {
+		minor = -minor
+	}
+	return minor, nil
+}
+
+// formatMinorUnits formats hundredths like "%.2f" formats the amount.
+func formatMinorUnits(minor int64) string {
+	sign := ""
+	if minor < 0 {
+		sign = "-"
+		minor = -minor
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, minor/100, minor%100)
+}
+
+const (
+	OrderTypeBuy     = "INSTANCE_BUY"
+	OrderTypeRenew   = "INSTANCE_RENEW"
+	OrderTypeUpgrade = "INSTANCE_UPGRADE"
+
+	PaymentTypeAuto = "AUTO"
+	PaymentTypeHand = "HAND"
+
+	CycleMonth = "Month"
+	CycleYear  = "Year"
+)
+
+type CreateOrderOptions struct {
+	OrderType   string // defaults to OrderTypeBuy
+	PaymentType string // defaults to PaymentTypeAuto
+	Quantity    int    // defaults to 1
+	InstanceId  string // required for OrderTypeRenew and OrderTypeUpgrade
+	SkuCode     string // defaults to "prepay"
+	ClientToken string // idempotency token of at most 64 characters, defaults to a random one
+
+	// Commodity replaces the Commodity built from the option and the fields
+	// above, see BuildCommodity.
+	Commodity json.RawMessage
+}
+
+type MarketOrderResult struct {
+	OrderId    string
+	PaymentURL string // where to complete the payment of PaymentTypeHand orders
+}
+
+func (client *MarketClient) CreateOrder(ctx context.Context, option MarketProductOptionWithPrice, overrides ...interface{}) (string, error) {
+	result, err := client.createOrder(ctx, option, CreateOrderOptions{}, overrides)
+	if result == nil {
+		return "", err
+	}
+	return result.OrderId, err
+}
+
+// CreateOrderWithOptions creates an order of the option. If the order is
+// created but a PaymentTypeHand order has no PayUrl, the result with the
+// OrderId is returned along with the error, so the order can still be paid
+// or cancelled.
+func (client *MarketClient) CreateOrderWithOptions(ctx context.Context, option MarketProductOptionWithPrice, opts CreateOrderOptions) (*MarketOrderResult, error) {
+	return client.createOrder(ctx, option, opts, nil)
+}
+
+func (client *MarketClient) createOrder(ctx context.Context, option MarketProductOptionWithPrice, opts CreateOrderOptions, overrides []interface{}) (*MarketOrderResult, error) {
+	if opts.OrderType == "" {
+		opts.OrderType = OrderTypeBuy
+	}
+	if opts.PaymentType == "" {
+		opts.PaymentType = PaymentTypeAuto
+	}
+	if opts.Quantity == 0 {
+		opts.Quantity = 1
+	}
+	if opts.SkuCode == "" {
+		opts.SkuCode = "prepay"
+	}
+	if opts.Commodity == nil {
+		if strings.TrimSpace(opts.SkuCode) == "" {
+			return nil, errors.New("sku code must not be blank")
+		}
+		if opts.Quantity < 1 {
+			return nil, fmt.Errorf("invalid quantity %d: must be at least 1", opts.Quantity)
+		}
+		if option.Duration < 1 {
+			return nil, fmt.Errorf("invalid duration %d: must be at least 1", option.Duration)
+		}
+		if option.Cycle != CycleMonth && option.Cycle != CycleYear {
+			return nil, fmt.Errorf("invalid cycle %q: must be %s or %s", option.Cycle, CycleMonth, CycleYear)
+		}
+	}
+	if err := checkInstanceId(opts.OrderType, opts.InstanceId); err != nil {
+		return nil, err
+	}
+	n, err := client.nonceLength()
+	if err != nil {
+		return nil, err
+	}
 	params := url.Values{}
 	params.Set("Action", "CreateOrder")
-	params.Set("ClientToken", randomString(64))
-	params.Set("OrderType", "INSTANCE_BUY") // INSTANCE_BUY, INSTANCE_RENEW or INSTANCE_UPGRADE
-	params.Set("PaymentType", "AUTO")       // AUTO or HAND
-	commodity, _ := json.Marshal(struct {
-		Components   map[string]string `json:"components"`
-		SkuCode      string            `json:"skuCode"`
-		Duration     int               `json:"duration"`
-		PricingCycle string            `json:"pricingCycle"`
-		ProductCode  string            `json:"productCode"`
-	}{
-		map[string]string{"package_version": option.Code},
-		"prepay",
-		option.Duration,
-		option.Cycle,
-		option.Id,
-	})
+	clientToken := opts.ClientToken
+	if clientToken == "" {
+		clientToken, err = client.nonce(n)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(clientToken) > 64 {
+		return nil, fmt.Errorf("invalid client token %q: must be at most 64 characters", clientToken)
+	}
+	params.Set("ClientToken", clientToken)
+	params.Set("OrderType", opts.OrderType)
+	params.Set("PaymentType", opts.PaymentType)
+	commodity := opts.Commodity
+	if commodity == nil {
+		var components map[string]string
+		if option.Code != "" {
+			components = map[string]string{"package_version": option.Code}
+		}
+		commodity, err = Commodity{
+			Components:   components,
+			SkuCode:      opts.SkuCode,
+			Duration:     option.Duration,
+			PricingCycle: option.Cycle,
+			ProductCode:  option.Id,
+			Quantity:     opts.Quantity,
+			InstanceId:   opts.InstanceId,
+		}.Marshal()
+		if err != nil {
+			return nil, err
+		}
+	}
 	params.Set("Commodity", string(commodity))
 	for i := 0; i < len(overrides)/2; i++ {
 		if a, ok := overrides[2*i].(string); ok {
@@ -233,55 +1123,466 @@ func (client MarketClient) CreateOrder(ctx context.Context, option MarketProduct
 			}
 		}
 	}
-	fmt.Println(params)
 	var resp struct {
 		OrderId string `json:"OrderId"`
+		PayUrl  string `json:"PayUrl"`
 	}
-	err := client.request(ctx, params, &resp)
+	err = client.request(ctx, params, &resp)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	result := &MarketOrderResult{
+		OrderId:    resp.OrderId,
+		PaymentURL: resp.PayUrl,
+	}
+	if params.Get("PaymentType") == PaymentTypeHand && resp.PayUrl == "" {
+		// the order exists already, keep its id
+		return result, fmt.Errorf("no payment url returned for order %s", resp.OrderId)
 	}
-	return resp.OrderId, nil
+	return result, nil
 }
 
-func (client MarketClient) request(ctx context.Context, params url.Values, target interface{}) error {
-	ts := time.Now().UTC().Format("2006-01-02T15:04:05Z")
-	params.Set("Format", "json")
-	params.Set("Version", "2015-11-01")
-	params.Set("AccessKeyId", client.accessKeyId)
-	params.Set("SignatureMethod", "HMAC-SHA1")
-	params.Set("Timestamp", ts)
-	params.Set("SignatureVersion", "1.0")
-	params.Set("SignatureNonce", randomString(64))
-	query := buildQueryString(params)
-	signature := sign(client.accessKeySecret, urlEncode(query))
-	params.Set("Signature", signature)
-	req, err := http.NewRequestWithContext(ctx, "GET", "https://market.aliyuncs.com/?"+params.Encode(), nil)
+// Purchase buys the option of the product, pricing it first to get the
+// duration and cycle of the order.
+func (client *MarketClient) Purchase(ctx context.Context, productCode, optionCode string) (*MarketOrderResult, error) {
+	product, err := client.GetProduct(ctx, productCode)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to get product %s: %w", productCode, err)
+	}
+	found := false
+	for _, option := range product.Options {
+		if option.Code == optionCode {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("product %s has no option %s", productCode, optionCode)
+	}
+	price, err := client.GetPrice(ctx, productCode, optionCode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get price of %s option %s: %w", productCode, optionCode, err)
+	}
+	result, err := client.CreateOrderWithOptions(ctx, *price, CreateOrderOptions{})
+	if err != nil {
+		return result, fmt.Errorf("failed to create order of %s option %s: %w", productCode, optionCode, err)
+	}
+	return result, nil
+}
+
+type RenewOptions struct {
+	Duration    int    // defaults to 1
+	Cycle       string // defaults to CycleMonth
+	Concurrency int    // defaults to 5
+	RetryBudget int    // total retries shared by all renewals, 0 for no limit
+}
+
+type RenewResult struct {
+	Instance MarketInstance
+	OrderId  string
+	Err      error
+}
+
+// RenewExpiring renews every instance expiring before the given time
+// concurrently, returning a result for each of them. The orders keep the
+// package of the instances. The ClientToken of the order of an instance is
+// the hex SHA-256 of its id, its current expiry time and the renewal period,
+// so running it again after a partial failure does not renew an instance
+// twice.
+func (client *MarketClient) RenewExpiring(ctx context.Context, before time.Time, opts RenewOptions) ([]RenewResult, error) {
+	if opts.Duration == 0 {
+		opts.Duration = 1
+	}
+	if opts.Cycle == "" {
+		opts.Cycle = CycleMonth
+	}
+	instances, err := client.ExpiringBefore(ctx, before)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list instances: %w", err)
+	}
+	results := make([]RenewResult, len(instances))
+	for i, instance := range instances {
+		results[i].Instance = instance
+	}
+	if opts.RetryBudget > 0 {
+		ctx = WithRetryBudget(ctx, NewRetryBudget(opts.RetryBudget))
+	}
+	forEach(len(results), opts.Concurrency, func(i int) {
+		instance := results[i].Instance
+		option := MarketProductOptionWithPrice{
+			Id:       instance.ProductCode,
+			Duration: opts.Duration,
+			Cycle:    opts.Cycle,
+		}
+		result, err := client.CreateOrderWithOptions(ctx, option, CreateOrderOptions{
+			OrderType:   OrderTypeRenew,
+			InstanceId:  instance.Id,
+			SkuCode:     instance.SkuCode,
+			ClientToken: renewClientToken(instance, opts.Duration, opts.Cycle),
+		})
+		if err != nil {
+			results[i].Err = fmt.Errorf("failed to renew instance %s: %w", instance.Id, err)
+			return
+		}
+		results[i].OrderId = result.OrderId
+	})
+	return results, nil
+}
+
+func renewClientToken(instance MarketInstance, duration int, cycle string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%d/%d/%s", instance.Id, instance.ExpiredAt.Unix(), duration, cycle)))
+	return hex.EncodeToString(sum[:])
+}
+
+func checkInstanceId(orderType, instanceId string) error {
+	switch orderType {
+	case OrderTypeBuy:
+		return nil
+	case OrderTypeRenew, OrderTypeUpgrade:
+		if instanceId == "" {
+			return fmt.Errorf("instance id is required for order type %s", orderType)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown order type %s", orderType)
+}
+
+func (client *MarketClient) nonceLength() (int, error) {
+	if client.NonceLength == 0 {
+		return MaxNonceLength, nil
+	}
+	if client.NonceLength < MinNonceLength || client.NonceLength > MaxNonceLength {
+		return 0, fmt.Errorf("invalid nonce length %d: must be between %d and %d", client.NonceLength, MinNonceLength, MaxNonceLength)
 	}
-	resp, err := http.DefaultClient.Do(req)
+	return client.NonceLength, nil
+}
+
+type MarketError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *MarketError) Error() string {
+	return fmt.Sprintf("server responded status %d with code %s and message %s returned", e.StatusCode, e.Code, e.Message)
+}
+
+var (
+	ErrProductNotFound = errors.New("product not found")
+
+	// ErrInsufficientBalance is returned when the account balance cannot pay
+	// an order of PaymentTypeAuto. Retrying does not help until it is topped
+	// up.
+	ErrInsufficientBalance = errors.New("insufficient account balance")
+)
+
+// marketErrorCodes maps sentinel errors to the codes of MarketError which
+// match them with errors.Is.
+var marketErrorCodes = map[error][]string{
+	ErrProductNotFound: {
+		"isv.PRODUCT_NOT_FOUND",
+		"PRODUCT_NOT_FOUND",
+		"PRODUCT_NOT_EXIST",
+		"ProductNotFound",
+		"InvalidProduct.NotFound",
+		"InvalidProductCode.NotFound",
+	},
+	ErrInsufficientBalance: {
+		"InsufficientBalance",
+		"Account.Arrearage",
+		"ORDER.ARREARAGE",
+		"PAY.INSUFFICIENT_BALANCE",
+		"NotEnoughBalance",
+	},
+}
+
+func (e *MarketError) Is(target error) bool {
+	for _, code := range marketErrorCodes[target] {
+		if e.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *MarketError) isThrottling() bool {
+	return e.StatusCode == http.StatusTooManyRequests || strings.HasPrefix(e.Code, "Throttling")
+}
+
+func (e *MarketError) isTimestampError() bool {
+	return e.Code == "SignatureDoesNotMatch" || e.Code == "IllegalTimestamp" || strings.HasPrefix(e.Code, "InvalidTimeStamp")
+}
+
+// ClockOffset returns the difference between the server clock and the local
+// clock detected by CorrectClockSkew, not including TimeOffset.
+func (client *MarketClient) ClockOffset() time.Duration {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.clockOffset
+}
+
+func (client *MarketClient) timestamp() time.Time {
+	return client.now().Add(client.TimeOffset + client.ClockOffset())
+}
+
+func (client *MarketClient) nonce(n int) (string, error) {
+	randString := randomString
+	if client.RandStringFunc != nil {
+		randString = client.RandStringFunc
+	}
+	nonce, err := randString(n)
 	if err != nil {
+		return "", fmt.Errorf("failed to generate random string: %w", err)
+	}
+	return nonce, nil
+}
+
+func (client *MarketClient) request(ctx context.Context, params url.Values, target interface{}) error {
+	timeout := client.ReadTimeout
+	if params.Get("Action") == "CreateOrder" {
+		timeout = client.OrderTimeout
+	}
+	ctx, cancel := client.withTimeout(ctx, timeout)
+	defer cancel()
+	header, err := client.send(ctx, params, target)
+	var merr *MarketError
+	if err == nil || !client.CorrectClockSkew || !errors.As(err, &merr) || !merr.isTimestampError() {
 		return err
 	}
+	date, perr := http.ParseTime(header.Get("Date"))
+	if perr != nil {
+		return err
+	}
+	// compare with the timestamp the request was signed with, not the
+	// current offset, which concurrent requests may have corrected already
+	signedAt, perr := time.Parse("2006-01-02T15:04:05Z", params.Get("Timestamp"))
+	if perr != nil {
+		return err
+	}
+	if offset := date.Sub(signedAt); offset > -maxClockSkew && offset < maxClockSkew {
+		// clocks agree, the error is not caused by skew
+		return err
+	}
+	client.mu.Lock()
+	client.clockOffset = date.Sub(client.now()) - client.TimeOffset
+	client.mu.Unlock()
+	_, err = client.send(ctx, params, target)
+	return err
+}
+
+// ServerTime returns the time of the Date header of the response of a request
+// of one metering item, to compare with the local clock. Errors of the
+// response, like a signature rejected due to clock skew, are ignored as long
+// as it has a Date header.
+func (client *MarketClient) ServerTime(ctx context.Context) (time.Time, error) {
+	ctx, cancel := client.withTimeout(ctx, client.ReadTimeout)
+	defer cancel()
+	params := url.Values{}
+	params.Set("Action", "DescribeApiMetering")
+	params.Set("type", "1")
+	params.Set("pageNum", "1")
+	params.Set("pageSize", "1")
+	var resp struct{}
+	header, err := client.send(ctx, params, &resp)
+	if header == nil {
+		return time.Time{}, err
+	}
+	date := header.Get("Date")
+	if date == "" {
+		return time.Time{}, errors.New("no Date header in response")
+	}
+	return http.ParseTime(date)
+}
+
+// Close stops the background work of the client. Requests made after Close
+// return ErrClosed. It is safe to call Close more than once.
+func (client *MarketClient) Close() error {
+	return client.closer.close()
+}
+
+func (client *MarketClient) send(ctx context.Context, params url.Values, target interface{}) (http.Header, error) {
+	if client.closer.isClosed() {
+		return nil, ErrClosed
+	}
+	n, err := client.nonceLength()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.do(ctx, func() (*http.Request, error) {
+		u, err := client.signedURL("GET", "/", params, n)
+		if err != nil {
+			return nil, err
+		}
+		return http.NewRequestWithContext(ctx, "GET", u, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
 	defer resp.Body.Close()
+	decode := client.decode
+	if client.format() == FormatXML {
+		decode = client.decodeXML
+	}
 	if resp.StatusCode != 200 {
 		var err struct {
 			Code    string `json:"Code"`
 			Message string `json:"Message"`
 		}
-		json.NewDecoder(resp.Body).Decode(&err)
-		return fmt.Errorf("server responded status %d with code %s and message %s returned", resp.StatusCode, err.Code, err.Message)
+		decode(resp, &err)
+		return resp.Header, &MarketError{
+			StatusCode: resp.StatusCode,
+			Code:       err.Code,
+			Message:    err.Message,
+		}
+	}
+	return resp.Header, decode(resp, target)
+}
+
+// SignedURL returns the signed URL of a request of the HTTP method to the
+// resource path with params, which should contain at least the Action, for
+// example to reproduce a request elsewhere. The URL is only valid for a short
+// time and can be used only once.
+func (client *MarketClient) SignedURL(method, path string, params url.Values) (string, error) {
+	n, err := client.nonceLength()
+	if err != nil {
+		return "", err
 	}
-	return json.NewDecoder(resp.Body).Decode(target)
+	copied := url.Values{}
+	for key, values := range params {
+		copied[key] = append([]string(nil), values...)
+	}
+	return client.signedURL(method, path, copied, n)
 }
 
-func sign(secret string, query string) string {
+// CurlCommand returns a curl command of the SignedURL of a GET request to "/"
+// with params. If redact is true, AccessKeyId and SecurityToken are replaced.
+// The secret is never included.
+func (client *MarketClient) CurlCommand(params url.Values, redact bool) (string, error) {
+	signed, err := client.SignedURL("GET", "/", params)
+	if err != nil {
+		return "", err
+	}
+	if redact {
+		u, err := url.Parse(signed)
+		if err != nil {
+			return "", err
+		}
+		query := u.Query()
+		for _, key := range []string{"AccessKeyId", "SecurityToken"} {
+			if query.Has(key) {
+				query.Set(key, "REDACTED")
+			}
+		}
+		u.RawQuery = query.Encode()
+		signed = u.String()
+	}
+	return "curl '" + strings.ReplaceAll(signed, "'", `'\''`) + "'", nil
+}
+
+func (client *MarketClient) signedURL(method, path string, params url.Values, nonceLength int) (string, error) {
+	if path == "" {
+		path = "/"
+	}
+	ts := client.timestamp().UTC().Format("2006-01-02T15:04:05Z")
+	params.Set("Format", client.format())
+	params.Set("Version", "2015-11-01")
+	params.Set("AccessKeyId", client.accessKeyId)
+	params.Set("SignatureMethod", "HMAC-SHA1")
+	params.Set("Timestamp", ts)
+	params.Set("SignatureVersion", "1.0")
+	nonce, err := client.nonce(nonceLength)
+	if err != nil {
+		return "", err
+	}
+	params.Set("SignatureNonce", nonce)
+	if client.SecurityToken != "" {
+		params.Set("SecurityToken", client.SecurityToken)
+	}
+	if client.OwnerId != "" {
+		params.Set("OwnerId", client.OwnerId)
+	}
+	if client.RegionId != "" {
+		params.Set("RegionId", client.RegionId)
+	}
+	query := buildQueryString(params)
+	if client.Debug {
+		// credentials are redacted, so compare the other parameters
+		redacted := buildQueryString(redactParams(params))
+		client.debugf("canonical query string: %s", redacted)
+		client.debugf("string to sign: %s", stringToSign(method, path, urlEncode(redacted)))
+	}
+	signature, err := client.sign(method, path, urlEncode(query))
+	if err != nil {
+		return "", fmt.Errorf("failed to sign request: %w", err)
+	}
+	params.Set("Signature", signature)
+	return client.endpoint(DefaultMarketEndpoint) + path + "?" + params.Encode(), nil
+}
+
+func (client *MarketClient) format() string {
+	if strings.EqualFold(client.Format, FormatXML) {
+		return FormatXML
+	}
+	return FormatJSON
+}
+
+func (client *MarketClient) sign(method, path, query string) (string, error) {
+	if client.SignFunc != nil {
+		return client.SignFunc(stringToSign(method, path, query))
+	}
+	return sign(client.accessKeySecret, method, path, query), nil
+}
+
+// stringToSign returns the string to sign of a request of the HTTP method to
+// the resource path, with the percent-encoded canonical query string.
+func stringToSign(method, path, query string) string {
+	if path == "" {
+		path = "/"
+	}
+	return strings.ToUpper(method) + "&" + urlEncode(path) + "&" + query
+}
+
+func sign(secret, method, path, query string) string {
 	mac := hmac.New(sha1.New, []byte(secret+"&"))
-	mac.Write([]byte("GET&%2F&" + query))
+	mac.Write([]byte(stringToSign(method, path, query)))
 	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
 }
 
+// ComputeSignature returns the signature of a request of the HTTP method to
+// the resource path with params, which must include all the parameters sent
+// like Timestamp and SignatureNonce, using the secret. Any Signature in params
+// is ignored. It makes no request, for example to reproduce the signature of
+// a failed one.
+func ComputeSignature(method, path string, params url.Values, secret string) string {
+	return sign(secret, method, path, urlEncode(buildQueryString(params)))
+}
+
+// VerifySigning signs the example request of the Alicloud RPC signature docs
+// and returns an error if the result differs from the documented signature.
+func VerifySigning() error {
+	params := url.Values{}
+	params.Set("Timestamp", "2016-02-23T12:46:24Z")
+	params.Set("Format", "XML")
+	params.Set("AccessKeyId", "testid")
+	params.Set("Action", "DescribeRegions")
+	params.Set("SignatureMethod", "HMAC-SHA1")
+	params.Set("SignatureNonce", "3ee8c1b8-83d3-44af-a94f-4e0ad82fd6cf")
+	params.Set("Version", "2014-05-26")
+	params.Set("SignatureVersion", "1.0")
+	const wantQuery = "AccessKeyId%3Dtestid%26Action%3DDescribeRegions%26Format%3DXML%26SignatureMethod%3DHMAC-SHA1" +
+		"%26SignatureNonce%3D3ee8c1b8-83d3-44af-a94f-4e0ad82fd6cf%26SignatureVersion%3D1.0" +
+		"%26Timestamp%3D2016-02-23T12%253A46%253A24Z%26Version%3D2014-05-26"
+	const wantSignature = "OLeaidS1JvxuMvnyHOwuJ+uX5qY="
+	query := urlEncode(buildQueryString(params))
+	if query != wantQuery {
+		return fmt.Errorf("canonical query string %s does not match %s", query, wantQuery)
+	}
+	if signature := sign("testsecret", "GET", "/", query); signature != wantSignature {
+		return fmt.Errorf("signature %s does not match %s", signature, wantSignature)
+	}
+	return nil
+}
+
 func urlEncode(input string) string {
 	return strings.Replace(url.QueryEscape(input), "+", "%20", -1)
 }
@@ -304,12 +1605,21 @@ func buildQueryString(params url.Values) string {
 	return queryString
 }
 
-func randomString(n int) string {
+func randomString(n int) (string, error) {
 	const alphanum = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
-	var bytes = make([]byte, n)
-	rand.Read(bytes)
-	for i, b := range bytes {
-		bytes[i] = alphanum[b%byte(len(alphanum))]
+	// bytes from max up are dropped so every character is equally likely
+	const max = 256 / len(alphanum) * len(alphanum)
+	result := make([]byte, 0, n)
+	buf := make([]byte, n)
+	for len(result) < n {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for _, b := range buf {
+			if int(b) < max && len(result) < n {
+				result = append(result, alphanum[int(b)%len(alphanum)])
+			}
+		}
 	}
-	return string(bytes)
+	return string(result), nil
 }
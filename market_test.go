@@ -0,0 +1,501 @@
+package alicloudapislim
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemainingPercent(t *testing.T) {
+	tests := []struct {
+		product MarketProduct
+		want    float64
+	}{
+		{MarketProduct{Remaining: 100, Used: 0}, 100},
+		{MarketProduct{Remaining: 25, Used: 75}, 25},
+		{MarketProduct{Remaining: 0, Used: 10}, 0},
+		{MarketProduct{Remaining: 0, Used: 0}, 0},
+	}
+	for _, test := range tests {
+		if got := test.product.RemainingPercent(); got != test.want {
+			t.Errorf("RemainingPercent() of %+v = %v, want %v", test.product, got, test.want)
+		}
+	}
+}
+
+func TestCorrectClockSkewConcurrently(t *testing.T) {
+	const ahead = 10 * time.Minute
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now().Add(ahead)
+		w.Header().Set("Date", now.UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Type", "application/json")
+		ts, _ := time.Parse("2006-01-02T15:04:05Z", r.URL.Query().Get("Timestamp"))
+		if d := now.Sub(ts); d > maxClockSkew || d < -maxClockSkew {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"Code":"InvalidTimeStamp.Expired","Message":"Specified time stamp or date value is expired."}`)
+			return
+		}
+		fmt.Fprint(w, `{"Code":"cmapi00001","Name":"test"}`)
+	}))
+	defer server.Close()
+	client := NewMarketClient("testid", "testsecret", WithEndpoint(server.URL))
+	client.CorrectClockSkew = true
+	errs := make([]error, 5)
+	forEach(len(errs), len(errs), func(i int) {
+		_, errs[i] = client.GetProduct(context.Background(), "cmapi00001")
+	})
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("request %d: %v", i, err)
+		}
+	}
+	if offset := client.ClockOffset(); offset < ahead-maxClockSkew || offset > ahead+maxClockSkew {
+		t.Errorf("ClockOffset() = %v, want about %v", offset, ahead)
+	}
+}
+
+func TestGetProductsWithoutCount(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"Success":true,"PageSize":10,"Result":[{"ProductCode":"cmapi00001","ProductName":"test","TotalQuota":100}]}`)
+	}))
+	defer server.Close()
+	client := NewMarketClient("testid", "testsecret", WithEndpoint(server.URL))
+	products, err := client.GetProducts(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(products) != 1 || products[0].Id != "cmapi00001" {
+		t.Errorf("GetProducts() = %+v, want the product of the first page", products)
+	}
+}
+
+func TestCreateOrderWithoutPayURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"OrderId":"200000000001"}`)
+	}))
+	defer server.Close()
+	client := NewMarketClient("testid", "testsecret", WithEndpoint(server.URL))
+	option := MarketProductOptionWithPrice{Id: "cmapi00001", Code: "basic", Duration: 1, Cycle: CycleMonth}
+	result, err := client.CreateOrderWithOptions(context.Background(), option, CreateOrderOptions{PaymentType: PaymentTypeHand})
+	if err == nil {
+		t.Error("CreateOrderWithOptions without a PayUrl should fail")
+	}
+	if result == nil || result.OrderId != "200000000001" {
+		t.Errorf("CreateOrderWithOptions() = %+v, want the OrderId of the created order", result)
+	}
+}
+
+func TestCommodityJSON(t *testing.T) {
+	var commodity string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		commodity = r.URL.Query().Get("Commodity")
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"OrderId":"200000000001","TradePrice":10}`)
+	}))
+	defer server.Close()
+	client := NewMarketClient("testid", "testsecret", WithEndpoint(server.URL))
+	ctx := context.Background()
+	option := MarketProductOptionWithPrice{Id: "cmapi00001", Code: "basic", Duration: 3, Cycle: CycleMonth}
+	tests := []struct {
+		name string
+		call func() error
+		want string
+	}{
+		{
+			"GetPrice",
+			func() error {
+				_, err := client.GetPrice(ctx, "cmapi00001", "basic")
+				return err
+			},
+			`{"components":{"package_version":"basic"},"productCode":"cmapi00001"}`,
+		},
+		{
+			"GetPriceWithOptions",
+			func() error {
+				_, err := client.GetPriceWithOptions(ctx, "cmapi00001", "basic", PriceOptions{OrderType: OrderTypeUpgrade, InstanceId: "1001", Quantity: 2})
+				return err
+			},
+			`{"components":{"package_version":"basic"},"productCode":"cmapi00001","quantity":2,"instanceId":"1001"}`,
+		},
+		{
+			"CreateOrder",
+			func() error {
+				_, err := client.CreateOrder(ctx, option)
+				return err
+			},
+			`{"components":{"package_version":"basic"},"skuCode":"prepay","duration":3,"pricingCycle":"Month","productCode":"cmapi00001","quantity":1}`,
+		},
+		{
+			"CreateOrderWithOptions",
+			func() error {
+				_, err := client.CreateOrderWithOptions(ctx, option, CreateOrderOptions{OrderType: OrderTypeUpgrade, InstanceId: "1001", Quantity: 2, SkuCode: "postpay"})
+				return err
+			},
+			`{"components":{"package_version":"basic"},"skuCode":"postpay","duration":3,"pricingCycle":"Month","productCode":"cmapi00001","quantity":2,"instanceId":"1001"}`,
+		},
+	}
+	for _, test := range tests {
+		if err := test.call(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if commodity != test.want {
+			t.Errorf("%s sent Commodity %s, want %s", test.name, commodity, test.want)
+		}
+	}
+}
+
+func TestVerifySigning(t *testing.T) {
+	if err := VerifySigning(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignPath(t *testing.T) {
+	query := urlEncode("Action=DescribePrice")
+	const want = "POST&%2Fapi%2Fv1&Action%3DDescribePrice"
+	if got := stringToSign("post", "/api/v1", query); got != want {
+		t.Errorf("stringToSign() = %s, want %s", got, want)
+	}
+	if got := stringToSign("GET", "", query); got != "GET&%2F&Action%3DDescribePrice" {
+		t.Errorf("stringToSign() without a path = %s, want the root path", got)
+	}
+	const wantSignature = "3F4zOlpV0Wf90VYQfQyvS3tLZww="
+	if got := sign("testsecret", "POST", "/api/v1", query); got != wantSignature {
+		t.Errorf("sign() = %s, want %s", got, wantSignature)
+	}
+}
+
+func TestFlexInt(t *testing.T) {
+	tests := []struct {
+		json    string
+		want    flexInt
+		wantErr bool
+	}{
+		{`42`, 42, false},
+		{`"42"`, 42, false},
+		{`" 42 "`, 42, false},
+		{`""`, 0, false},
+		{`"null"`, 0, false},
+		{`null`, 0, false},
+		{`"abc"`, 0, true},
+		{`4.2`, 0, true},
+	}
+	for _, test := range tests {
+		var n flexInt
+		err := json.Unmarshal([]byte(test.json), &n)
+		if (err != nil) != test.wantErr || n != test.want {
+			t.Errorf("decoding %s = %d, %v, want %d and error %v", test.json, n, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestDecodeBOM(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/getExpressList" {
+			fmt.Fprint(w, "\xef\xbb\xbf\r\n"+`{"status":"200","msg":"ok","result":{"YTO":"圆通速递"}}`)
+			return
+		}
+		fmt.Fprint(w, "\xef\xbb\xbf"+`{"Code":"cmapi00001","Name":"test"}`)
+	}))
+	defer server.Close()
+	market := NewMarketClient("testid", "testsecret", WithEndpoint(server.URL))
+	product, err := market.GetProduct(context.Background(), "cmapi00001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if product.Id != "cmapi00001" {
+		t.Errorf("GetProduct() = %+v, want product cmapi00001", product)
+	}
+	wuliu := NewWuliuClient("appcode", WithEndpoint(server.URL))
+	providers, err := wuliu.GetProviders(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(providers) != 1 || providers[0].Code != "YTO" {
+		t.Errorf("GetProviders() = %+v, want YTO", providers)
+	}
+}
+
+func TestToMinorUnits(t *testing.T) {
+	tests := []struct {
+		amount  float64
+		want    int64
+		price   string
+		wantErr bool
+	}{
+		{1.005, 101, "1.01", false},
+		{2.675, 268, "2.68", false},
+		{0.125, 13, "0.13", false},
+		{0.124, 12, "0.12", false},
+		{10, 1000, "10.00", false},
+		{0, 0, "0.00", false},
+		{-1.005, -101, "-1.01", false},
+		{-0.05, -5, "-0.05", false},
+		{1e21, 0, "", true},
+	}
+	for _, test := range tests {
+		got, err := toMinorUnits(test.amount)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("toMinorUnits(%v) = %d, %v, want %d and error %v", test.amount, got, err, test.want, test.wantErr)
+			continue
+		}
+		if !test.wantErr && formatMinorUnits(got) != test.price {
+			t.Errorf("formatMinorUnits(%d) = %s, want %s", got, formatMinorUnits(got), test.price)
+		}
+	}
+}
+
+func TestGetPriceMinorUnits(t *testing.T) {
+	for _, test := range []struct {
+		tradePrice string
+		price      string
+		minor      int64
+	}{
+		{"1.005", "1.01", 101},
+		{"2.675", "2.68", 268},
+		{"0.125", "0.13", 13},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"ProductCode":"cmapi00001","TradePrice":%s,"Currency":"CNY"}`, test.tradePrice)
+		}))
+		client := NewMarketClient("testid", "testsecret", WithEndpoint(server.URL))
+		price, err := client.GetPrice(context.Background(), "cmapi00001", "basic")
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if price.Price != test.price || price.PriceMinor != test.minor {
+			t.Errorf("TradePrice %s: got Price %s and PriceMinor %d, want %s and %d", test.tradePrice, price.Price, price.PriceMinor, test.price, test.minor)
+		}
+	}
+}
+
+func TestGetPriceOriginalPrice(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"ProductCode":"cmapi00001","TradePrice":0.125,"OriginalPrice":2.675,"DiscountPrice":2.55,"Currency":"CNY"}`)
+	}))
+	defer server.Close()
+	client := NewMarketClient("testid", "testsecret", WithEndpoint(server.URL))
+	price, err := client.GetPrice(context.Background(), "cmapi00001", "basic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if price.OriginalPrice != "2.68" || price.OriginalPriceMinor != 268 || price.DiscountPrice != "2.55" {
+		t.Errorf("got OriginalPrice %s, OriginalPriceMinor %d and DiscountPrice %s, want 2.68, 268 and 2.55", price.OriginalPrice, price.OriginalPriceMinor, price.DiscountPrice)
+	}
+	if got, want := price.DiscountPercent(), float64(268-13)/268*100; got != want {
+		t.Errorf("DiscountPercent() = %v, want %v", got, want)
+	}
+}
+
+func TestDebugRedactsCredentials(t *testing.T) {
+	var logs strings.Builder
+	client := NewMarketClient("testid", "testsecret", WithDebug(true), WithLogger(log.New(&logs, "", 0)))
+	client.SecurityToken = "testtoken"
+	params := url.Values{}
+	params.Set("Action", "DescribeProduct")
+	if _, err := client.SignedURL("GET", "/", params); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), "string to sign: GET&%2F&AccessKeyId%3DREDACTED%26Action%3DDescribeProduct") {
+		t.Errorf("got logs %q, want the string to sign with AccessKeyId redacted", logs.String())
+	}
+	for _, secret := range []string{"testid", "testtoken", "testsecret"} {
+		if strings.Contains(logs.String(), secret) {
+			t.Errorf("got logs %q, want no %s", logs.String(), secret)
+		}
+	}
+}
+
+func TestMarketClientClosed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"Code":"cmapi00001","Name":"test"}`)
+	}))
+	defer server.Close()
+	client := NewMarketClient("testid", "testsecret", WithEndpoint(server.URL))
+	client.ProductCacheTTL = time.Hour
+	ctx := context.Background()
+	// the product has no options, so the catalog needs no prices
+	if _, err := client.GetFullProduct(ctx, "cmapi00001"); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if _, err := client.GetFullProduct(ctx, "cmapi00001"); !errors.Is(err, ErrClosed) {
+		t.Errorf("GetFullProduct after Close = %v, want ErrClosed", err)
+	}
+	if _, err := client.GetProduct(ctx, "cmapi00001"); !errors.Is(err, ErrClosed) {
+		t.Errorf("GetProduct after Close = %v, want ErrClosed", err)
+	}
+}
+
+func TestCommodityQuantity(t *testing.T) {
+	tests := []struct {
+		quantity int
+		want     string
+		wantErr  bool
+	}{
+		{0, `{"productCode":"cmapi00001"}`, false},
+		{1, `{"productCode":"cmapi00001","quantity":1}`, false},
+		{-1, "", true},
+	}
+	for _, test := range tests {
+		got, err := Commodity{ProductCode: "cmapi00001", Quantity: test.quantity}.Marshal()
+		if (err != nil) != test.wantErr || string(got) != test.want {
+			t.Errorf("Marshal() of quantity %d = %s, %v, want %s and error %v", test.quantity, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestGetProductsUnsuccessful(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"Success":false,"Code":"InvalidParameter","Message":"bad"}`)
+	}))
+	defer server.Close()
+	client := NewMarketClient("testid", "testsecret", WithEndpoint(server.URL))
+	_, err := client.GetProducts(context.Background())
+	var marketErr *MarketError
+	if !errors.As(err, &marketErr) || marketErr.StatusCode != 200 || marketErr.Code != "InvalidParameter" {
+		t.Errorf("GetProducts() = %v, want a MarketError with status 200 and code InvalidParameter", err)
+	}
+}
+
+func TestDecodeGzip(t *testing.T) {
+	gzipped := func(body string) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		io.WriteString(gz, body)
+		gz.Close()
+		return buf.Bytes()
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		switch r.URL.Path {
+		case "/getExpressList":
+			w.Write(gzipped(`{"status":"200","msg":"ok","result":{"YTO":"圆通速递"}}`))
+		case "/exCompany":
+			w.Write([]byte("not gzip"))
+		default:
+			w.Write(gzipped(`{"Code":"cmapi00001","Name":"test"}`))
+		}
+	}))
+	defer server.Close()
+	// a transport asking for gzip decompresses the body itself, so use one
+	// which does not, like when a proxy compresses the body anyway
+	httpClient := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	market := NewMarketClient("testid", "testsecret", WithEndpoint(server.URL), WithHTTPClient(httpClient))
+	if product, err := market.GetProduct(context.Background(), "cmapi00001"); err != nil || product.Id != "cmapi00001" {
+		t.Errorf("GetProduct() = %+v, %v, want product cmapi00001", product, err)
+	}
+	wuliu := NewWuliuClient("appcode", WithEndpoint(server.URL), WithHTTPClient(httpClient))
+	if providers, err := wuliu.GetProviders(context.Background()); err != nil || len(providers) != 1 {
+		t.Errorf("GetProviders() = %+v, %v, want YTO", providers, err)
+	}
+	if _, err := wuliu.GetProvidersForNumber(context.Background(), "YT1234567890123"); err == nil {
+		t.Error("GetProvidersForNumber with an invalid gzip body should fail")
+	}
+}
+
+func TestFormatXML(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if format := r.URL.Query().Get("Format"); format != FormatXML {
+			t.Errorf("got Format %s, want %s", format, FormatXML)
+		}
+		w.Header().Set("Content-Type", "text/xml")
+		if r.URL.Query().Get("Code") != "cmapi00001" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>isv.PRODUCT_NOT_FOUND</Code><Message>not found</Message></Error>`)
+			return
+		}
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<DescribeProductResponse>
+  <Code>cmapi00001</Code>
+  <Name>test</Name>
+  <ProductSkus><ProductSku><ChargeType>PREPAY</ChargeType><Modules><Module>
+    <Code>package_version</Code>
+    <Properties><Property><Key>package_version</Key><PropertyValues>
+      <PropertyValue><Type>enum</Type><DisplayName>Basic</DisplayName><Value>basic</Value></PropertyValue>
+    </PropertyValues></Property></Properties>
+  </Module></Modules></ProductSku></ProductSkus>
+</DescribeProductResponse>`)
+	}))
+	defer server.Close()
+	client := NewMarketClient("testid", "testsecret", WithEndpoint(server.URL))
+	client.Format = "XML"
+	product, err := client.GetProduct(context.Background(), "cmapi00001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if product.Name != "test" || len(product.Options) != 1 || product.Options[0].Code != "basic" {
+		t.Errorf("GetProduct() = %+v, want product test with option basic", product)
+	}
+	if _, err := client.GetProduct(context.Background(), "cmapi99999"); !errors.Is(err, ErrProductNotFound) {
+		t.Errorf("GetProduct() of a missing product = %v, want ErrProductNotFound", err)
+	}
+}
+
+func TestDebugCapture(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"Code":"%s","Name":"test"}`, r.URL.Query().Get("Code"))
+	}))
+	defer server.Close()
+	client := NewMarketClient("testid", "testsecret", WithEndpoint(server.URL))
+	client.SecurityToken = "testtoken"
+	if entries := client.LastRequests(); entries != nil {
+		t.Errorf("LastRequests() without capturing = %+v, want nil", entries)
+	}
+	client.EnableDebugCapture(2)
+	for _, code := range []string{"cmapi00001", "cmapi00002", "cmapi00003"} {
+		product, err := client.GetProduct(context.Background(), code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the body is still decoded after being captured
+		if product.Id != code {
+			t.Errorf("GetProduct(%s) = %+v", code, product)
+		}
+	}
+	entries := client.LastRequests()
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	for i, code := range []string{"cmapi00002", "cmapi00003"} {
+		entry := entries[i]
+		u, err := url.Parse(entry.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		query := u.Query()
+		if query.Get("Code") != code || entry.StatusCode != 200 || !strings.Contains(string(entry.Body), code) {
+			t.Errorf("entry %d = %+v, want the request of %s", i, entry, code)
+		}
+		for _, key := range []string{"AccessKeyId", "Signature", "SecurityToken"} {
+			if query.Get(key) != "REDACTED" {
+				t.Errorf("entry %d has %s %q, want it redacted", i, key, query.Get(key))
+			}
+		}
+	}
+	client.EnableDebugCapture(0)
+	if entries := client.LastRequests(); entries != nil {
+		t.Errorf("LastRequests() after disabling = %+v, want nil", entries)
+	}
+}
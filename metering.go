@@ -0,0 +1,65 @@
+package alicloudapislim
+
+import "time"
+
+type MarketProductDelta struct {
+	Id             string
+	Name           string
+	UsedDelta      int
+	RemainingDelta int
+	Added          bool // only in the new snapshot
+	Removed        bool // only in the old snapshot
+}
+
+// DiffProducts compares two metering snapshots by product Id, returning the
+// deltas of products in new in their order, followed by removed products.
+func DiffProducts(old, new []MarketProduct) []MarketProductDelta {
+	previous := make(map[string]MarketProduct, len(old))
+	for _, product := range old {
+		previous[product.Id] = product
+	}
+	deltas := []MarketProductDelta{}
+	seen := make(map[string]bool, len(new))
+	for _, product := range new {
+		seen[product.Id] = true
+		prev, ok := previous[product.Id]
+		deltas = append(deltas, MarketProductDelta{
+			Id:             product.Id,
+			Name:           product.Name,
+			UsedDelta:      product.Used - prev.Used,
+			RemainingDelta: product.Remaining - prev.Remaining,
+			Added:          !ok,
+		})
+	}
+	for _, product := range old {
+		if seen[product.Id] {
+			continue
+		}
+		deltas = append(deltas, MarketProductDelta{
+			Id:             product.Id,
+			Name:           product.Name,
+			UsedDelta:      -product.Used,
+			RemainingDelta: -product.Remaining,
+			Removed:        true,
+		})
+	}
+	return deltas
+}
+
+// PredictDepletion extrapolates when the quota of a product runs out from two
+// metering snapshots of it taken at prevAt and curAt, assuming usage goes on
+// at the same rate. It returns the predicted time and the rate in units used
+// per second, or false if usage did not grow between the snapshots.
+func PredictDepletion(prev, cur MarketProduct, prevAt, curAt time.Time) (time.Time, float64, bool) {
+	elapsed := curAt.Sub(prevAt).Seconds()
+	used := cur.Used - prev.Used
+	if elapsed <= 0 || used <= 0 {
+		return time.Time{}, 0, false
+	}
+	rate := float64(used) / elapsed
+	if cur.Remaining <= 0 {
+		return curAt, rate, true
+	}
+	seconds := float64(cur.Remaining) / rate
+	return curAt.Add(time.Duration(seconds * float64(time.Second))), rate, true
+}
@@ -0,0 +1,75 @@
+package alicloudapislim
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// Option configures the Config of a client in NewMarketClient, NewWuliuClient
+// and their FromEnv variants.
+type Option func(*Config)
+
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(config *Config) { config.HTTPClient = httpClient }
+}
+
+func WithEndpoint(endpoint string) Option {
+	return func(config *Config) { config.Endpoint = endpoint }
+}
+
+func WithUserAgent(userAgent string) Option {
+	return func(config *Config) { config.UserAgent = userAgent }
+}
+
+func WithRetry(policy RetryPolicy) Option {
+	return func(config *Config) { config.Retry = policy }
+}
+
+func WithMaxResponseBytes(n int64) Option {
+	return func(config *Config) { config.MaxResponseBytes = n }
+}
+
+func WithTimeout(timeout time.Duration) Option {
+	return func(config *Config) { config.DefaultTimeout = timeout }
+}
+
+func WithLogger(logger *log.Logger) Option {
+	return func(config *Config) { config.Logger = logger }
+}
+
+func WithDebug(debug bool) Option {
+	return func(config *Config) { config.Debug = debug }
+}
+
+func WithOnRequest(onRequest func(RequestInfo)) Option {
+	return func(config *Config) { config.OnRequest = onRequest }
+}
+
+func WithHeaders(headers http.Header) Option {
+	return func(config *Config) { config.Headers = headers }
+}
+
+func WithRequestMutator(mutator func(*http.Request)) Option {
+	return func(config *Config) { config.RequestMutator = mutator }
+}
+
+func WithStrictDecoding(strict bool) Option {
+	return func(config *Config) { config.StrictDecoding = strict }
+}
+
+// WithRateLimit limits the requests of the client to rate per second, with
+// bursts of up to burst requests.
+func WithRateLimit(rate float64, burst int) Option {
+	return func(config *Config) { config.RateLimiter = NewRateLimiter(rate, burst) }
+}
+
+func WithCorrelationHeader(header string) Option {
+	return func(config *Config) { config.CorrelationHeader = header }
+}
+
+func (config *Config) apply(opts []Option) {
+	for _, opt := range opts {
+		opt(config)
+	}
+}
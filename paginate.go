@@ -0,0 +1,127 @@
+package alicloudapislim
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+// pagination describes how a list action of the Market API is paged.
+type pagination struct {
+	numberKey string // query parameter of the page number
+	sizeKey   string // query parameter of the page size
+	pageSize  int    // 0 for the default of the server
+	maxPages  int    // 0 for all pages
+	partial   bool   // return the pages fetched with the error of the others
+}
+
+// params returns a copy of params requesting the page of pageNum.
+func (p pagination) params(params url.Values, pageNum int) url.Values {
+	values := url.Values{}
+	for key, value := range params {
+		values[key] = append([]string(nil), value...)
+	}
+	values.Set(p.numberKey, strconv.Itoa(pageNum))
+	if p.pageSize > 0 {
+		values.Set(p.sizeKey, strconv.Itoa(p.pageSize))
+	}
+	return values
+}
+
+type marketPage[T any] struct {
+	items  []T
+	count  int // total number of items of all pages
+	size   int // page size the server used
+	number int // page number the server returned, 0 if unknown
+}
+
+type marketPages[T any] struct {
+	items   []T
+	count   int
+	fetched int
+	size    int   // page size the server used for the first page
+	numbers []int // page numbers the server returned, in order
+}
+
+// paginate fetches the first page to learn the number of pages, then fetches
+// the remaining pages concurrently, returning the items of all pages in order.
+// At most p.maxPages pages are fetched if it is positive. If p.partial is true
+// and some pages after the first fail, the items of the other pages are
+// returned along with the first error.
+func paginate[T any](ctx context.Context, p pagination, params url.Values, fetch func(ctx context.Context, params url.Values) (*marketPage[T], error)) (*marketPages[T], error) {
+	first, err := fetch(ctx, p.params(params, 1))
+	if err != nil {
+		return nil, err
+	}
+	totalPages := 1
+	if first.size > 0 && len(first.items) > 0 {
+		totalPages = (first.count + first.size - 1) / first.size
+	}
+	if totalPages < 1 {
+		// the first page has items even if the server reports no count
+		totalPages = 1
+	}
+	if p.maxPages > 0 && totalPages > p.maxPages {
+		totalPages = p.maxPages
+	}
+	pages := make([]*marketPage[T], totalPages)
+	pages[0] = first
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var once sync.Once
+	var firstErr error
+	forEach(totalPages-1, defaultConcurrency, func(i int) {
+		page, err := fetch(ctx, p.params(params, i+2))
+		if err != nil {
+			once.Do(func() {
+				firstErr = err
+				if !p.partial {
+					cancel()
+				}
+			})
+			return
+		}
+		pages[i+1] = page
+	})
+	if firstErr != nil && !p.partial {
+		return nil, firstErr
+	}
+	result := &marketPages[T]{
+		items:   []T{},
+		count:   first.count,
+		size:    first.size,
+		numbers: []int{},
+	}
+	for _, page := range pages {
+		if page != nil {
+			result.items = append(result.items, page.items...)
+			result.fetched++
+			result.numbers = append(result.numbers, page.number)
+		}
+	}
+	return result, firstErr
+}
+
+// paginateUntil fetches the pages one by one until stop returns true for an
+// item, returning the items up to and including it, or all items if it never
+// does. At most p.maxPages pages are fetched if it is positive.
+func paginateUntil[T any](ctx context.Context, p pagination, params url.Values, fetch func(ctx context.Context, params url.Values) (*marketPage[T], error), stop func(T) bool) ([]T, bool, error) {
+	items := []T{}
+	for pageNum := 1; p.maxPages <= 0 || pageNum <= p.maxPages; pageNum++ {
+		page, err := fetch(ctx, p.params(params, pageNum))
+		if err != nil {
+			return nil, false, err
+		}
+		for _, item := range page.items {
+			items = append(items, item)
+			if stop(item) {
+				return items, true, nil
+			}
+		}
+		if len(page.items) == 0 || page.size <= 0 || pageNum*page.size >= page.count {
+			break
+		}
+	}
+	return items, false, nil
+}
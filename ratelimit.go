@@ -0,0 +1,71 @@
+package alicloudapislim
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket limiting how many requests are sent per
+// second. It can be shared by clients calling the same api.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens added per second
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time // time.Now if nil, replaced in tests
+}
+
+// NewRateLimiter returns a limiter allowing rate requests per second on
+// average and burst requests at once. A burst below 1 is 1.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// Wait blocks until a request may be sent or ctx is done.
+func (limiter *RateLimiter) Wait(ctx context.Context) error {
+	if limiter == nil || limiter.rate <= 0 {
+		return nil
+	}
+	d := limiter.reserve()
+	if d <= 0 {
+		return nil
+	}
+	if err := sleep(ctx, d); err != nil {
+		// give back the token not used
+		limiter.mu.Lock()
+		limiter.tokens = math.Min(limiter.burst, limiter.tokens+1)
+		limiter.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// reserve takes a token, returning how long to wait until it is available.
+func (limiter *RateLimiter) reserve() time.Duration {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	now := time.Now()
+	if limiter.now != nil {
+		now = limiter.now()
+	}
+	if !limiter.last.IsZero() {
+		elapsed := now.Sub(limiter.last).Seconds()
+		limiter.tokens = math.Min(limiter.burst, limiter.tokens+elapsed*limiter.rate)
+	}
+	limiter.last = now
+	limiter.tokens--
+	if limiter.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-limiter.tokens / limiter.rate * float64(time.Second))
+}
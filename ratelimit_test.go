@@ -0,0 +1,66 @@
+package alicloudapislim
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	now := time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter(10, 2)
+	limiter.now = func() time.Time { return now }
+	tests := []struct {
+		advance time.Duration
+		want    time.Duration
+	}{
+		{0, 0}, // the burst is available at once
+		{0, 0},
+		{0, 100 * time.Millisecond},
+		{0, 200 * time.Millisecond},
+		{time.Second, 0}, // refilled
+		{0, 0},
+		{0, 100 * time.Millisecond},
+	}
+	for i, test := range tests {
+		now = now.Add(test.advance)
+		if got := limiter.reserve(); got != test.want {
+			t.Errorf("reserve %d = %v, want %v", i, got, test.want)
+		}
+	}
+}
+
+func TestRateLimiterWaitCancelled(t *testing.T) {
+	limiter := NewRateLimiter(0.001, 1)
+	if err := limiter.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := limiter.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait() = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestGetStatusesForNumbersRateLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, kdiInTransit)
+	}))
+	defer server.Close()
+	client := NewWuliuClient("appcode", WithEndpoint(server.URL), WithRateLimit(50, 1))
+	start := time.Now()
+	numbers := []string{"YT0000000000001", "YT0000000000002", "YT0000000000003", "YT0000000000004", "YT0000000000005"}
+	for no, result := range client.GetStatusesForNumbers(context.Background(), "YTO", numbers) {
+		if result.Err != nil {
+			t.Errorf("%s: %v", no, result.Err)
+		}
+	}
+	// the first request is sent at once, the others 20ms apart
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("5 requests at 50 per second took %v, want at least 80ms", elapsed)
+	}
+}
@@ -0,0 +1,128 @@
+package alicloudapislim
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type RetryPolicy struct {
+	MaxRetries int           // 0 disables retrying
+	Backoff    time.Duration // delay before the first retry, doubled after each retry
+	MaxBackoff time.Duration // upper limit of the delay, 0 for no limit
+
+	// MaxElapsedTime stops retrying, returning the last error, when the time
+	// since the first attempt including the next delay would exceed it. The
+	// delay is the Retry-After of the response instead of the backoff when
+	// present.
+	MaxElapsedTime time.Duration
+
+	// RetryableFunc decides whether a request is retried after the response or
+	// error of an attempt, replacing the default of retrying network errors
+	// unless the context is done, 429 Too Many Requests and 5xx responses.
+	RetryableFunc func(resp *http.Response, err error) bool
+}
+
+func (policy RetryPolicy) retryable(ctx context.Context, resp *http.Response, err error) bool {
+	if policy.RetryableFunc != nil {
+		return policy.RetryableFunc(resp, err)
+	}
+	return shouldRetry(ctx, resp, err)
+}
+
+func (policy RetryPolicy) delay(backoff time.Duration) time.Duration {
+	if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+		return policy.MaxBackoff
+	}
+	return backoff
+}
+
+// next returns the backoff after backoff, doubled but at most MaxBackoff, or
+// the longest duration without MaxBackoff, so it never overflows.
+func (policy RetryPolicy) next(backoff time.Duration) time.Duration {
+	if backoff > math.MaxInt64/2 {
+		return math.MaxInt64
+	}
+	return policy.delay(backoff * 2)
+}
+
+// parseRetryAfter parses a Retry-After header of either seconds or an HTTP
+// date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if d := date.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
+
+// RetryBudget is a pool of retries shared by a group of requests, so the total
+// number of retries stays capped no matter how many of the requests fail.
+type RetryBudget struct {
+	mu     sync.Mutex
+	tokens int
+}
+
+func NewRetryBudget(n int) *RetryBudget {
+	return &RetryBudget{tokens: n}
+}
+
+func (budget *RetryBudget) Remaining() int {
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+	return budget.tokens
+}
+
+func (budget *RetryBudget) take() bool {
+	if budget == nil {
+		return true
+	}
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+	if budget.tokens <= 0 {
+		return false
+	}
+	budget.tokens--
+	return true
+}
+
+type retryBudgetKey struct{}
+
+// WithRetryBudget returns a context making every request made with it draw its
+// retries from budget, in addition to the client's RetryPolicy.
+func WithRetryBudget(ctx context.Context, budget *RetryBudget) context.Context {
+	return context.WithValue(ctx, retryBudgetKey{}, budget)
+}
+
+func retryBudgetFromContext(ctx context.Context) *RetryBudget {
+	budget, _ := ctx.Value(retryBudgetKey{}).(*RetryBudget)
+	return budget
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
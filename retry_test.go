@@ -0,0 +1,110 @@
+package alicloudapislim
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoffDoesNotOverflow(t *testing.T) {
+	tests := []struct {
+		policy RetryPolicy
+		max    time.Duration
+	}{
+		{RetryPolicy{Backoff: time.Millisecond, MaxBackoff: time.Second}, time.Second},
+		{RetryPolicy{Backoff: time.Millisecond}, math.MaxInt64},
+	}
+	for _, test := range tests {
+		backoff := test.policy.Backoff
+		for i := 0; i < 100; i++ {
+			backoff = test.policy.next(backoff)
+			if backoff <= 0 || backoff > test.max {
+				t.Fatalf("backoff after %d retries = %v, want between 0 and %v", i+1, backoff, test.max)
+			}
+		}
+		if backoff != test.max {
+			t.Errorf("backoff after 100 retries = %v, want %v", backoff, test.max)
+		}
+	}
+}
+
+func TestRetryManyTimes(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	client := NewWuliuClient("appcode", WithEndpoint(server.URL), WithRetry(RetryPolicy{
+		MaxRetries: 100,
+		Backoff:    time.Nanosecond,
+		MaxBackoff: 100 * time.Microsecond,
+	}))
+	if _, err := client.GetProviders(context.Background()); err == nil {
+		t.Error("GetProviders should fail")
+	}
+	if attempts != 101 {
+		t.Errorf("got %d attempts, want 101", attempts)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"3", 3 * time.Second, true},
+		{" 0 ", 0, true},
+		{"-1", 0, false},
+		{"soon", 0, false},
+		{"Mon, 01 May 2023 00:00:10 GMT", 10 * time.Second, true},
+		{"Sun, 30 Apr 2023 23:59:00 GMT", 0, true}, // in the past
+	}
+	for _, test := range tests {
+		got, ok := parseRetryAfter(test.value, now)
+		if got != test.want || ok != test.ok {
+			t.Errorf("parseRetryAfter(%q) = %v, %v, want %v, %v", test.value, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name           string
+		retryAfter     string
+		maxElapsedTime time.Duration
+		attempts       int
+	}{
+		{"honored", "0", 0, 2},
+		{"beyond MaxElapsedTime", "3600", time.Minute, 1},
+	}
+	for _, test := range tests {
+		attempts := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			if attempts == 1 {
+				w.Header().Set("Retry-After", test.retryAfter)
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.Write([]byte(`{"status":"200","msg":"ok","result":{}}`))
+		}))
+		// the backoff alone would exceed the test timeout
+		client := NewWuliuClient("appcode", WithEndpoint(server.URL), WithRetry(RetryPolicy{
+			MaxRetries:     1,
+			Backoff:        time.Hour,
+			MaxElapsedTime: test.maxElapsedTime,
+		}))
+		client.GetProviders(context.Background())
+		server.Close()
+		if attempts != test.attempts {
+			t.Errorf("%s: got %d attempts, want %d", test.name, attempts, test.attempts)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package alicloudapislim_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caiguanhao/alicloudapislim"
+	"github.com/caiguanhao/alicloudapislim/alicloudapislimtest"
+)
+
+func TestFilterProviders(t *testing.T) {
+	server := alicloudapislimtest.NewServer()
+	defer server.Close()
+	server.Providers["ZTO"] = "中通快递"
+	server.Providers["SFEXPRESS"] = "顺丰速运"
+	server.Providers["STO"] = "申通快递"
+	server.Providers["YTO"] = "圆通速递"
+	client := server.NewWuliuClient()
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"to", []string{"STO", "YTO", "ZTO"}},
+		{"快递", []string{"STO", "ZTO"}},
+		{"sf", []string{"SFEXPRESS"}},
+		{"", []string{"SFEXPRESS", "STO", "YTO", "ZTO"}},
+		{"EMS", []string{}},
+	}
+	for _, test := range tests {
+		providers, err := client.FilterProviders(context.Background(), test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		codes := []string{}
+		for _, provider := range providers {
+			codes = append(codes, provider.Code)
+		}
+		if !reflect.DeepEqual(codes, test.want) {
+			t.Errorf("FilterProviders(%q) = %v, want %v", test.query, codes, test.want)
+		}
+	}
+}
+
+func TestRenewExpiring(t *testing.T) {
+	server := alicloudapislimtest.NewServer()
+	defer server.Close()
+	now := time.Now()
+	server.Instances = []alicloudapislim.MarketInstance{
+		{Id: "1001", ProductCode: "cmapi00001", SkuCode: "prepay", ExpiredAt: now.Add(24 * time.Hour)},
+		{Id: "1002", ProductCode: "cmapi00001", SkuCode: "prepay", ExpiredAt: now.Add(90 * 24 * time.Hour)},
+	}
+	client := server.NewMarketClient()
+	var orderIds []string
+	for i := 0; i < 2; i++ {
+		results, err := client.RenewExpiring(context.Background(), now.Add(7*24*time.Hour), alicloudapislim.RenewOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 || results[0].Err != nil {
+			t.Fatalf("RenewExpiring() = %+v, want one renewal of instance 1001", results)
+		}
+		orderIds = append(orderIds, results[0].OrderId)
+	}
+	if orderIds[0] != orderIds[1] {
+		t.Errorf("renewing twice created orders %v, want the same order", orderIds)
+	}
+	if len(server.Orders) != 1 {
+		t.Fatalf("got %d orders, want 1", len(server.Orders))
+	}
+	order := server.Orders[0]
+	if order.OrderType != alicloudapislim.OrderTypeRenew {
+		t.Errorf("got OrderType %s, want %s", order.OrderType, alicloudapislim.OrderTypeRenew)
+	}
+	var commodity map[string]interface{}
+	if err := json.Unmarshal(order.Commodity, &commodity); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := commodity["components"]; ok || commodity["instanceId"] != "1001" {
+		t.Errorf("got Commodity %s, want instance 1001 without components", order.Commodity)
+	}
+}
+
+func TestCreateOrder(t *testing.T) {
+	server := alicloudapislimtest.NewServer()
+	defer server.Close()
+	server.VerifySignatures = true
+	server.Prices[alicloudapislimtest.PriceKey("cmapi00001", "basic")] = alicloudapislimtest.Price{TradePrice: 10, Duration: 1, Cycle: alicloudapislim.CycleMonth}
+	client := server.NewMarketClient()
+	price, err := client.GetPrice(context.Background(), "cmapi00001", "basic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orderId, err := client.CreateOrder(context.Background(), *price)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(server.Orders) != 1 || server.Orders[0].OrderId != orderId {
+		t.Fatalf("got orders %+v, want order %s", server.Orders, orderId)
+	}
+	order := server.Orders[0]
+	if order.OrderType != alicloudapislim.OrderTypeBuy {
+		t.Errorf("got OrderType %s, want %s", order.OrderType, alicloudapislim.OrderTypeBuy)
+	}
+	const want = `{"components":{"package_version":"basic"},"skuCode":"prepay","duration":1,"pricingCycle":"Month","productCode":"cmapi00001","quantity":1}`
+	if string(order.Commodity) != want {
+		t.Errorf("got Commodity %s, want %s", order.Commodity, want)
+	}
+}
+
+func TestGetProductsStringNumbers(t *testing.T) {
+	server := alicloudapislimtest.NewServer()
+	defer server.Close()
+	server.StringNumbers = true
+	server.PageSize = 2
+	server.Products = []alicloudapislim.MarketProduct{
+		{Id: "cmapi00001", Name: "a", Remaining: 100, Used: 5, Unit: "次"},
+		{Id: "cmapi00002", Name: "b", Remaining: 200, Used: 10, Unit: "次"},
+		{Id: "cmapi00003", Name: "c", Remaining: 300, Used: 15, Unit: "次"},
+	}
+	client := server.NewMarketClient()
+	list, err := client.GetProductList(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(list.Products, server.Products) {
+		t.Errorf("got products %+v, want %+v", list.Products, server.Products)
+	}
+	if list.TotalCount != 3 || list.PageSize != 2 || !reflect.DeepEqual(list.PageNumbers, []int{1, 2}) {
+		t.Errorf("got TotalCount %d, PageSize %d and PageNumbers %v, want 3, 2 and [1 2]", list.TotalCount, list.PageSize, list.PageNumbers)
+	}
+}
+
+func TestSignedURLWithPath(t *testing.T) {
+	server := alicloudapislimtest.NewServer()
+	defer server.Close()
+	server.VerifySignatures = true
+	server.Details["cmapi00001"] = alicloudapislim.MarketProductDetails{Id: "cmapi00001", Name: "test"}
+	client := server.NewMarketClient()
+	params := url.Values{}
+	params.Set("Action", "DescribeProduct")
+	params.Set("Code", "cmapi00001")
+	tests := []struct {
+		signMethod, signPath string // signed for
+		method, path         string // sent to
+		status               int
+	}{
+		{"POST", "/api/v1", "POST", "/api/v1", http.StatusOK},
+		{"GET", "/", "GET", "/", http.StatusOK},
+		{"GET", "/api/v1", "POST", "/api/v1", http.StatusBadRequest},
+		{"POST", "/api/v1", "POST", "/", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		signed, err := client.SignedURL(test.signMethod, test.signPath, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, _ := url.Parse(signed)
+		if u.Path != test.signPath {
+			t.Errorf("SignedURL(%s, %s) has path %s", test.signMethod, test.signPath, u.Path)
+		}
+		u.Path = test.path
+		req, _ := http.NewRequest(test.method, u.String(), nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s %s: got status %d, want %d", test.method, test.path, resp.StatusCode, test.status)
+		}
+	}
+}
+
+func TestMarketErrorStatus(t *testing.T) {
+	server := alicloudapislimtest.NewServer()
+	defer server.Close()
+	server.VerifySignatures = true
+	server.Products = []alicloudapislim.MarketProduct{{Id: "cmapi00001", Name: "test"}}
+	client := server.NewMarketClient()
+	wrongSecret := alicloudapislim.NewMarketClient("testid", "wrongsecret", alicloudapislim.WithEndpoint(server.URL))
+	ctx := context.Background()
+	if _, err := client.GetProducts(ctx); err != nil {
+		t.Errorf("GetProducts() = %v, want success", err)
+	}
+	tests := []struct {
+		name       string
+		call       func() error
+		statusCode int
+		code       string
+	}{
+		{"GetProduct", func() error { _, err := client.GetProduct(ctx, "cmapi99999"); return err }, 404, "isv.PRODUCT_NOT_FOUND"},
+		{"GetPrice", func() error { _, err := client.GetPrice(ctx, "cmapi99999", "basic"); return err }, 404, "isv.PRODUCT_NOT_FOUND"},
+		{"GetProducts", func() error { _, err := wrongSecret.GetProducts(ctx); return err }, 400, "SignatureDoesNotMatch"},
+	}
+	for _, test := range tests {
+		var marketErr *alicloudapislim.MarketError
+		if err := test.call(); !errors.As(err, &marketErr) || marketErr.StatusCode != test.statusCode || marketErr.Code != test.code {
+			t.Errorf("%s = %v, want a MarketError with status %d and code %s", test.name, err, test.statusCode, test.code)
+		}
+	}
+}
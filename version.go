@@ -0,0 +1,4 @@
+package alicloudapislim
+
+// Version is the version of this library, reported in the default User-Agent.
+const Version = "0.1.0"
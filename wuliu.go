@@ -3,18 +3,77 @@ package alicloudapislim
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"os"
+	"regexp"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode"
 )
 
+const DefaultWuliuEndpoint = "https://wuliu.market.alicloudapi.com"
+
+// DefaultWuliuLogoBaseURL is the host serving the logos of the Wuliu API,
+// which stays the same when Endpoint is changed.
+const DefaultWuliuLogoBaseURL = DefaultWuliuEndpoint + "/"
+
 type WuliuClient struct {
+	Config
+
 	AppCode string
 
-	providers []WuliuProvider
+	// DisableCache makes GetProviders always load the providers.
+	DisableCache bool
+
+	// ExtractCourierPhone fills WuliuStatus.CourierPhone with the first mobile
+	// number found in the items when the carrier leaves the field blank.
+	ExtractCourierPhone bool
+
+	// InferMissingStatus guesses WuliuStatus.Status from the latest item when
+	// the api returns no deliverystatus, instead of StatusUnknown.
+	InferMissingStatus bool
+
+	// RequireTrackingInfo makes GetStatusForNumber return ErrNoTrackingInfo
+	// instead of a status without items.
+	RequireTrackingInfo bool
+
+	// DedupeItems collapses repeated items in GetStatusForNumber, see Dedupe.
+	DedupeItems bool
+
+	// NumberCacheSize enables caching the providers GetProvidersForNumber
+	// detects for up to this many numbers. With NumberCachePrefix, numbers
+	// are cached by their first NumberCachePrefix characters instead, so
+	// similar numbers share one lookup.
+	NumberCacheSize   int
+	NumberCachePrefix int
+
+	// StatusOverrides maps the deliverystatus codes of the carriers of the
+	// keys to statuses, for carriers using codes differently. Codes missing
+	// there use the mapping shared by all carriers.
+	StatusOverrides map[string]map[string]string
+
+	// LogoBaseURL resolves relative logo paths of WuliuStatus.CompanyLogo,
+	// which are relative to the host serving the logos, not to Endpoint,
+	// defaults to DefaultWuliuLogoBaseURL.
+	LogoBaseURL string
+
+	// Location converts UpdatedAt and the item times of WuliuStatus, which
+	// are in UTC+8 as returned by the api, to this location, like time.UTC.
+	Location *time.Location
+
+	mu              sync.Mutex
+	providers       []WuliuProvider
+	providerNames   map[string]string // by code, of providers
+	providersLoaded bool
+	numbers         *lru[[]WuliuProvider]
+	refreshing      bool
+	closer          closer
 }
 
 type WuliuProvider struct {
@@ -23,17 +82,164 @@ type WuliuProvider struct {
 }
 
 type WuliuStatus struct {
-	Code         string
-	Number       string
-	Status       string
-	CompanyName  string
-	CompanyLogo  string
-	CompanyPhone string
-	CourierName  string
-	CourierPhone string
-	UpdatedAt    time.Time
-	TimeElapsed  string
-	Items        []WuliuStatusItem
+	Code          string
+	Number        string
+	Status        string
+	CompanyName   string
+	CompanyLogo   string   // absolute URL of the logo, empty if none
+	CompanyPhone  string   // first of CompanyPhones
+	CompanyPhones []string // all phones of the carrier
+	CompanySite   string   // website of the carrier
+	CourierName   string
+	CourierPhone  string
+	UpdatedAt     time.Time
+	TimeElapsed   string
+	Elapsed       time.Duration // TimeElapsed parsed, 0 if absent
+	Signed        bool          // whether the api marked the shipment signed
+	Items         []WuliuStatusItem
+
+	CompanyLogoRaw string // logo as returned by the api
+	DeliveryStatus string // status code as returned by the api, may be empty
+}
+
+func (status WuliuStatus) HasLogo() bool {
+	return status.CompanyLogo != ""
+}
+
+const (
+	StatusCollected  = "快递收件(揽件)"
+	StatusInTransit  = "在途中"
+	StatusDelivering = "正在派件"
+	StatusSigned     = "已签收"
+	StatusFailed     = "派送失败"
+	StatusProblem    = "疑难件"
+	StatusReturned   = "退件签收"
+	StatusUnknown    = "未知"
+)
+
+// deliveryStatuses maps the deliverystatus codes of the api to statuses.
+var deliveryStatuses = map[string]string{
+	"0": StatusCollected,
+	"1": StatusInTransit,
+	"2": StatusDelivering,
+	"3": StatusSigned,
+	"4": StatusFailed,
+	"5": StatusProblem,
+	"6": StatusReturned,
+}
+
+// inferStatus guesses the status from the description of the latest item.
+func inferStatus(items []WuliuStatusItem) string {
+	if len(items) == 0 {
+		return StatusUnknown
+	}
+	latest := items[0]
+	for _, item := range items[1:] {
+		if item.Time.After(latest.Time) {
+			latest = item
+		}
+	}
+	switch desc := latest.Desc; {
+	case strings.Contains(desc, "退") && strings.Contains(desc, "签收"):
+		return StatusReturned
+	case strings.Contains(desc, "签收"):
+		return StatusSigned
+	case strings.Contains(desc, "派件"), strings.Contains(desc, "派送"):
+		return StatusDelivering
+	case strings.Contains(desc, "揽收"), strings.Contains(desc, "揽件"), strings.Contains(desc, "收件"):
+		return StatusCollected
+	}
+	return StatusInTransit
+}
+
+// Dedupe returns a copy of the status with consecutive items of identical
+// description and time collapsed into one.
+func (status WuliuStatus) Dedupe() WuliuStatus {
+	items := []WuliuStatusItem{}
+	for i, item := range status.Items {
+		if i > 0 && item.Desc == status.Items[i-1].Desc && item.Time.Equal(status.Items[i-1].Time) {
+			continue
+		}
+		items = append(items, item)
+	}
+	status.Items = items
+	return status
+}
+
+// Normalize returns a copy of the status with whitespace of the texts trimmed
+// and collapsed, the code upper-cased and repeated company phones removed.
+func (status WuliuStatus) Normalize() WuliuStatus {
+	clean := func(s string) string { return strings.Join(strings.Fields(s), " ") }
+	status.Code = strings.ToUpper(strings.TrimSpace(status.Code))
+	status.Number = strings.TrimSpace(status.Number)
+	status.CompanyName = clean(status.CompanyName)
+	status.CompanySite = strings.TrimSpace(status.CompanySite)
+	status.CourierName = clean(status.CourierName)
+	status.CourierPhone = strings.TrimSpace(status.CourierPhone)
+	phones := []string{}
+	seen := map[string]bool{}
+	for _, phone := range status.CompanyPhones {
+		phone = strings.TrimSpace(phone)
+		if phone != "" && !seen[phone] {
+			seen[phone] = true
+			phones = append(phones, phone)
+		}
+	}
+	status.CompanyPhones = phones
+	status.CompanyPhone = strings.TrimSpace(status.CompanyPhone)
+	if len(phones) > 0 {
+		status.CompanyPhone = phones[0]
+	}
+	items := make([]WuliuStatusItem, len(status.Items))
+	for i, item := range status.Items {
+		item.Desc = clean(item.Desc)
+		items[i] = item
+	}
+	status.Items = items
+	return status
+}
+
+// String formats the shipment as a multi-line timeline, oldest item first.
+func (status WuliuStatus) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s (%s): %s\n", status.CompanyName, status.Number, status.Code, status.Status)
+	if status.CourierName != "" || status.CourierPhone != "" {
+		fmt.Fprintf(&b, "courier: %s %s\n", status.CourierName, status.CourierPhone)
+	}
+	items := append([]WuliuStatusItem(nil), status.Items...)
+	sort.SliceStable(items, func(i, j int) bool { return items[i].Time.Before(items[j].Time) })
+	for _, item := range items {
+		fmt.Fprintf(&b, "  %s  %s\n", item.Time.Format("2006-01-02 15:04:05"), item.Desc)
+	}
+	return b.String()
+}
+
+// HasChangedSince reports whether the status, the number of items or the
+// latest item differs from prev, which is nil for the first poll.
+func (status WuliuStatus) HasChangedSince(prev *WuliuStatus) bool {
+	if prev == nil {
+		return true
+	}
+	if status.Status != prev.Status || status.DeliveryStatus != prev.DeliveryStatus ||
+		status.Signed != prev.Signed || len(status.Items) != len(prev.Items) {
+		return true
+	}
+	latest, ok := status.latestItem()
+	prevLatest, _ := prev.latestItem()
+	return ok && (latest.Desc != prevLatest.Desc || !latest.Time.Equal(prevLatest.Time))
+}
+
+func (status WuliuStatus) latestItem() (WuliuStatusItem, bool) {
+	if len(status.Items) == 0 {
+		return WuliuStatusItem{}, false
+	}
+	latest := status.Items[0]
+	for _, item := range status.Items[1:] {
+		if item.Time.After(latest.Time) {
+			latest = item
+		}
+	}
+	return latest, true
 }
 
 type WuliuStatusItem struct {
@@ -41,24 +247,153 @@ type WuliuStatusItem struct {
 	Time time.Time
 }
 
-func NewWuliuClient(appCode string) *WuliuClient {
-	return &WuliuClient{
+type WuliuError struct {
+	Op         string
+	StatusCode int
+	Status     string
+	Message    string
+}
+
+func (e *WuliuError) Error() string {
+	if e.Status == "" {
+		return fmt.Sprintf("server responded status %d with message %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("failed to %s: status %s, message %s returned", e.Op, e.Status, e.Message)
+}
+
+// gatewayError is an error of the api gateway in front of the Wuliu API,
+// reported with the HTTP status and X-Ca-Error-Message.
+type gatewayError struct {
+	statusCode int
+	message    string // prefix of X-Ca-Error-Message, ignoring case
+}
+
+const (
+	gatewayUnauthorized  = "unauthorized"
+	gatewayQuotaExceeded = "quota exceeded"
+)
+
+// gatewayErrors maps the kinds of errors of the api gateway to the errors
+// reporting them.
+var gatewayErrors = map[string][]gatewayError{
+	gatewayUnauthorized: {
+		{http.StatusBadRequest, "Invalid AppCode"},
+		{http.StatusUnauthorized, "Invalid AppCode"},
+		{http.StatusForbidden, "Invalid AppCode"},
+		{http.StatusForbidden, "Unauthorized"},
+		{http.StatusForbidden, "Api Market Subscription expired"},
+	},
+	gatewayQuotaExceeded: {
+		{http.StatusForbidden, "Quota Exhausted"},
+		{http.StatusForbidden, "Api Market Subscription quota exhausted"},
+	},
+}
+
+func (e *WuliuError) isGatewayError(kind string) bool {
+	if e.Status != "" {
+		return false
+	}
+	for _, gatewayErr := range gatewayErrors[kind] {
+		if e.StatusCode == gatewayErr.statusCode && strings.HasPrefix(strings.ToLower(e.Message), strings.ToLower(gatewayErr.message)) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsUnauthorized reports whether the AppCode is invalid, expired or not
+// authorized for the API, meaning the key needs to be rotated.
+func (e *WuliuError) IsUnauthorized() bool {
+	return e.isGatewayError(gatewayUnauthorized)
+}
+
+// IsQuotaExceeded reports whether the purchased quota of the API is used up
+// ("Quota Exhausted" from the api gateway).
+func (e *WuliuError) IsQuotaExceeded() bool {
+	return e.isGatewayError(gatewayQuotaExceeded)
+}
+
+func NewWuliuClient(appCode string, opts ...Option) *WuliuClient {
+	client := &WuliuClient{
 		AppCode: appCode,
 	}
+	client.apply(opts)
+	return client
 }
 
-func (client WuliuClient) request(ctx context.Context, path string, target interface{}) error {
-	req, err := http.NewRequestWithContext(ctx, "GET", "https://wuliu.market.alicloudapi.com"+path, nil)
-	if err != nil {
-		return err
+const EnvWuliuAppCode = "ALIYUN_WULIU_APPCODE"
+
+// NewWuliuClientFromEnv creates a client with the AppCode in the
+// ALIYUN_WULIU_APPCODE environment variable.
+func NewWuliuClientFromEnv(opts ...Option) (*WuliuClient, error) {
+	appCode := os.Getenv(EnvWuliuAppCode)
+	if appCode == "" {
+		return nil, fmt.Errorf("environment variable %s is not set", EnvWuliuAppCode)
 	}
-	req.Header.Set("Authorization", "APPCODE "+client.AppCode)
-	resp, err := http.DefaultClient.Do(req)
+	return NewWuliuClient(appCode, opts...), nil
+}
+
+// Close stops the background work of the client. Requests made after Close
+// return ErrClosed. It is safe to call Close more than once.
+func (client *WuliuClient) Close() error {
+	return client.closer.close()
+}
+
+// wuliuEndpoint is an endpoint of the Wuliu API. The status of successful
+// responses differs between endpoints.
+type wuliuEndpoint struct {
+	op      string
+	path    string
+	success string
+}
+
+var (
+	wuliuExpressList = wuliuEndpoint{"get wuliu providers", "/getExpressList", "200"}
+	wuliuExCompany   = wuliuEndpoint{"get wuliu provider", "/exCompany", "0"}
+	wuliuKdi         = wuliuEndpoint{"get wuliu status", "/kdi", "0"}
+)
+
+// check returns a WuliuError with the raw status unless it is the status of
+// success of the endpoint.
+func (endpoint wuliuEndpoint) check(status, message string) error {
+	if status == endpoint.success {
+		return nil
+	}
+	return &WuliuError{Op: endpoint.op, StatusCode: 200, Status: status, Message: message}
+}
+
+func (client *WuliuClient) request(ctx context.Context, endpoint wuliuEndpoint, query url.Values, target interface{}) error {
+	if client.closer.isClosed() {
+		return ErrClosed
+	}
+	ctx, cancel := client.withTimeout(ctx, 0)
+	defer cancel()
+	resp, err := client.do(ctx, func() (*http.Request, error) {
+		u := client.endpoint(DefaultWuliuEndpoint) + endpoint.path
+		if len(query) > 0 {
+			u += "?" + query.Encode()
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "APPCODE "+client.AppCode)
+		return req, nil
+	})
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
-	return json.NewDecoder(resp.Body).Decode(target)
+	if resp.StatusCode != 200 {
+		// errors from the api gateway come in headers, e.g. "Invalid AppCode"
+		// or "Quota Exhausted", with an empty or non-json body
+		return &WuliuError{
+			Op:         endpoint.op,
+			StatusCode: resp.StatusCode,
+			Message:    resp.Header.Get("X-Ca-Error-Message"),
+		}
+	}
+	return client.decode(resp, target)
 }
 
 func (client *WuliuClient) MustGetProviders(ctx context.Context) []WuliuProvider {
@@ -70,35 +405,137 @@ func (client *WuliuClient) MustGetProviders(ctx context.Context) []WuliuProvider
 }
 
 func (client *WuliuClient) GetProviders(ctx context.Context) ([]WuliuProvider, error) {
-	if len(client.providers) > 0 {
-		return client.providers, nil
+	if client.closer.isClosed() {
+		return nil, ErrClosed
+	}
+	client.mu.Lock()
+	providers, loaded := client.providers, client.providersLoaded
+	client.mu.Unlock()
+	if loaded && !client.DisableCache {
+		return providers, nil
+	}
+	return client.loadProviders(ctx)
+}
+
+// GetProviderMap is like GetProviders but returns the names of the providers
+// by code. The map is shared with the cache and must not be modified.
+func (client *WuliuClient) GetProviderMap(ctx context.Context) (map[string]string, error) {
+	if client.closer.isClosed() {
+		return nil, ErrClosed
+	}
+	client.mu.Lock()
+	names, loaded := client.providerNames, client.providersLoaded
+	client.mu.Unlock()
+	if loaded && !client.DisableCache {
+		return names, nil
+	}
+	providers, err := client.loadProviders(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names = make(map[string]string, len(providers))
+	for _, provider := range providers {
+		names[provider.Code] = provider.Name
+	}
+	return names, nil
+}
+
+// ClearProvidersCache makes the next GetProviders load the providers again.
+func (client *WuliuClient) ClearProvidersCache() {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.providers = nil
+	client.providerNames = nil
+	client.providersLoaded = false
+}
+
+// FilterProviders returns the providers whose code or name contains query,
+// ignoring case.
+func (client *WuliuClient) FilterProviders(ctx context.Context, query string) ([]WuliuProvider, error) {
+	providers, err := client.GetProviders(ctx)
+	if err != nil {
+		return nil, err
+	}
+	query = strings.ToLower(query)
+	filtered := []WuliuProvider{}
+	for _, provider := range providers {
+		if strings.Contains(strings.ToLower(provider.Code), query) || strings.Contains(strings.ToLower(provider.Name), query) {
+			filtered = append(filtered, provider)
+		}
 	}
+	return filtered, nil
+}
+
+// RefreshProviders starts reloading the providers every interval in the
+// background, so GetProviders always returns from a warm cache. It stops when
+// the client is closed. Calling it again while refreshing does nothing. The
+// interval must be positive.
+func (client *WuliuClient) RefreshProviders(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid refresh interval %v: must be positive", interval)
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.refreshing {
+		return nil
+	}
+	client.refreshing = true
+	// closing the client also aborts a refresh in progress
+	ctx, cancel := client.closer.context()
+	go func() {
+		defer func() {
+			cancel()
+			client.mu.Lock()
+			client.refreshing = false
+			client.mu.Unlock()
+		}()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			// errors are ignored, the previous providers are kept
+			client.loadProviders(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+func (client *WuliuClient) loadProviders(ctx context.Context) ([]WuliuProvider, error) {
 	var ret struct {
 		Status  string            `json:"status"`
 		Message string            `json:"msg"`
 		Result  map[string]string `json:"result"`
 	}
-	if err := client.request(ctx, "/getExpressList", &ret); err != nil {
+	if err := client.request(ctx, wuliuExpressList, nil, &ret); err != nil {
 		return nil, err
 	}
-	if ret.Status != "200" {
-		return nil, fmt.Errorf("failed to get wuliu providers: status %s, message %s returned", ret.Status, ret.Message)
+	if err := wuliuExpressList.check(ret.Status, ret.Message); err != nil {
+		return nil, err
 	}
-	var providers []WuliuProvider
+	// an empty result is still a successful one and is cached as well
+	providers := []WuliuProvider{}
+	names := map[string]string{}
 	for code, name := range ret.Result {
 		providers = append(providers, WuliuProvider{
 			Code: code,
 			Name: name,
 		})
+		names[code] = name
 	}
-	if len(providers) > 0 {
-		sort.Slice(providers, func(i, j int) bool { return providers[i].Code < providers[j].Code })
-		client.providers = providers
-	}
+	sort.Slice(providers, func(i, j int) bool { return providers[i].Code < providers[j].Code })
+	client.mu.Lock()
+	client.providers = providers
+	client.providerNames = names
+	client.providersLoaded = true
+	client.mu.Unlock()
 	return providers, nil
 }
 
-func (client WuliuClient) MustGetProvidersForNumber(ctx context.Context, no string) []WuliuProvider {
+func (client *WuliuClient) MustGetProvidersForNumber(ctx context.Context, no string) []WuliuProvider {
 	providers, err := client.GetProvidersForNumber(ctx, no)
 	if err != nil {
 		panic(err)
@@ -106,7 +543,21 @@ func (client WuliuClient) MustGetProvidersForNumber(ctx context.Context, no stri
 	return providers
 }
 
-func (client WuliuClient) GetProvidersForNumber(ctx context.Context, no string) ([]WuliuProvider, error) {
+func (client *WuliuClient) GetProvidersForNumber(ctx context.Context, no string) ([]WuliuProvider, error) {
+	if client.closer.isClosed() {
+		return nil, ErrClosed
+	}
+	no = NormalizeNumber(no)
+	cache, key := client.numberCache(), no
+	if client.NumberCachePrefix > 0 && len(key) > client.NumberCachePrefix {
+		key = key[:client.NumberCachePrefix]
+	}
+	if cache != nil {
+		// copies are cached and returned, so callers cannot change the cache
+		if providers, ok := cache.get(key); ok {
+			return append([]WuliuProvider(nil), providers...), nil
+		}
+	}
 	values := url.Values{}
 	values.Set("no", no)
 	var ret struct {
@@ -118,11 +569,11 @@ func (client WuliuClient) GetProvidersForNumber(ctx context.Context, no string)
 			Name string `json:"name"`
 		} `json:"list"`
 	}
-	if err := client.request(ctx, "/exCompany?"+values.Encode(), &ret); err != nil {
+	if err := client.request(ctx, wuliuExCompany, values, &ret); err != nil {
 		return nil, err
 	}
-	if ret.Status != "0" {
-		return nil, fmt.Errorf("failed to get wuliu provider: status %s, message %s returned", ret.Status, ret.Message)
+	if err := wuliuExCompany.check(ret.Status, ret.Message); err != nil {
+		return nil, err
 	}
 	var providers []WuliuProvider
 	for _, item := range ret.List {
@@ -131,19 +582,43 @@ func (client WuliuClient) GetProvidersForNumber(ctx context.Context, no string)
 			Name: item.Name,
 		})
 	}
+	if cache != nil {
+		cache.add(key, append([]WuliuProvider(nil), providers...))
+	}
 	return providers, nil
 }
 
-func (client WuliuClient) MustGetStatusForNumber(ctx context.Context, code, no string) *WuliuStatus {
-	status, err := client.GetStatusForNumber(ctx, code, no)
+func (client *WuliuClient) numberCache() *lru[[]WuliuProvider] {
+	if client.NumberCacheSize <= 0 {
+		return nil
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.numbers == nil {
+		client.numbers = newLRU[[]WuliuProvider](client.NumberCacheSize)
+	}
+	return client.numbers
+}
+
+func (client *WuliuClient) MustGetStatusForNumber(ctx context.Context, code, no string, extra ...string) *WuliuStatus {
+	status, err := client.GetStatusForNumber(ctx, code, no, extra...)
 	if err != nil {
 		panic(err)
 	}
 	return status
 }
 
-func (client WuliuClient) GetStatusForNumber(ctx context.Context, code, no string) (*WuliuStatus, error) {
+// GetStatusForNumber gets the status of the shipment. Extra query parameters
+// some carriers accept can be passed as key and value pairs in extra.
+func (client *WuliuClient) GetStatusForNumber(ctx context.Context, code, no string, extra ...string) (*WuliuStatus, error) {
+	if len(extra)%2 != 0 {
+		return nil, fmt.Errorf("invalid extra parameters %q: must be key and value pairs", extra)
+	}
+	no = NormalizeNumber(no)
 	values := url.Values{}
+	for i := 0; i < len(extra)/2; i++ {
+		values.Set(extra[2*i], extra[2*i+1])
+	}
 	values.Set("type", code)
 	values.Set("no", no)
 	var ret struct {
@@ -168,50 +643,303 @@ func (client WuliuClient) GetStatusForNumber(ctx context.Context, code, no strin
 			Logo           string `json:"logo"`
 		} `json:"result"`
 	}
-	if err := client.request(ctx, "/kdi?"+values.Encode(), &ret); err != nil {
+	if err := client.request(ctx, wuliuKdi, values, &ret); err != nil {
+		return nil, err
+	}
+	if err := wuliuKdi.check(ret.Status, ret.Message); err != nil {
 		return nil, err
 	}
-	if ret.Status != "0" {
-		return nil, fmt.Errorf("failed to get wuliu status: status %s, message %s returned", ret.Status, ret.Message)
-	}
-	status := ret.Result.DeliveryStatus
-	switch status {
-	case "0":
-		status = "快递收件(揽件)"
-	case "1":
-		status = "在途中"
-	case "2":
-		status = "正在派件"
-	case "3":
-		status = "已签收"
-	case "4":
-		status = "派送失败"
-	case "5":
-		status = "疑难件"
-	case "6":
-		status = "退件签收"
-	}
-	loc := time.FixedZone("UTC+8", 8*60*60)
-	updatedAt, _ := time.ParseInLocation("2006-01-02 15:04:05", ret.Result.UpdateTime, loc)
+	updatedAt := client.parseTime(ret.Result.UpdateTime)
 	items := []WuliuStatusItem{}
 	for _, item := range ret.Result.List {
-		time, _ := time.ParseInLocation("2006-01-02 15:04:05", item.Time, loc)
 		items = append(items, WuliuStatusItem{
 			Desc: item.Status,
-			Time: time,
+			Time: client.parseTime(item.Time),
 		})
 	}
-	return &WuliuStatus{
-		Code:         ret.Result.Type,
-		Number:       ret.Result.Number,
-		Status:       status,
-		CompanyName:  ret.Result.ExpName,
-		CompanyLogo:  ret.Result.Logo,
-		CompanyPhone: ret.Result.ExpPhone,
-		CourierName:  ret.Result.Courier,
-		CourierPhone: ret.Result.CourierPhone,
-		UpdatedAt:    updatedAt,
-		TimeElapsed:  ret.Result.TakeTime,
-		Items:        items,
-	}, nil
+	if len(items) == 0 && client.RequireTrackingInfo {
+		return nil, ErrNoTrackingInfo
+	}
+	carrier := ret.Result.Type
+	if carrier == "" {
+		carrier = code
+	}
+	status := StatusUnknown
+	if name, ok := client.StatusOverrides[carrier][ret.Result.DeliveryStatus]; ok {
+		status = name
+	} else if name, ok := deliveryStatuses[ret.Result.DeliveryStatus]; ok {
+		status = name
+	} else if ret.Result.DeliveryStatus != "" {
+		status = ret.Result.DeliveryStatus
+	} else if client.InferMissingStatus {
+		status = inferStatus(items)
+	}
+	companyPhones := splitPhones(ret.Result.ExpPhone)
+	companyPhone := ""
+	if len(companyPhones) > 0 {
+		companyPhone = companyPhones[0]
+	}
+	courierPhone := ret.Result.CourierPhone
+	if courierPhone == "" && client.ExtractCourierPhone {
+		courierPhone = findPhone(items)
+	}
+	result := &WuliuStatus{
+		Code:          ret.Result.Type,
+		Number:        ret.Result.Number,
+		Status:        status,
+		CompanyName:   ret.Result.ExpName,
+		CompanyLogo:   client.logoURL(ret.Result.Logo),
+		CompanyPhone:  companyPhone,
+		CompanyPhones: companyPhones,
+		CompanySite:   strings.TrimSpace(ret.Result.ExpSite),
+		CourierName:   ret.Result.Courier,
+		CourierPhone:  courierPhone,
+		UpdatedAt:     updatedAt,
+		TimeElapsed:   ret.Result.TakeTime,
+		Elapsed:       parseTakeTime(ret.Result.TakeTime),
+		Signed:        ret.Result.IsSign == "1",
+		Items:         items,
+
+		CompanyLogoRaw: ret.Result.Logo,
+		DeliveryStatus: ret.Result.DeliveryStatus,
+	}
+	if client.DedupeItems {
+		*result = result.Dedupe()
+	}
+	return result, nil
+}
+
+var wuliuLocation = time.FixedZone("UTC+8", 8*60*60)
+
+// parseTime parses the UTC+8 times of the api, converting them to Location.
+func (client *WuliuClient) parseTime(value string) time.Time {
+	t, _ := time.ParseInLocation("2006-01-02 15:04:05", value, wuliuLocation)
+	if client.Location != nil {
+		t = t.In(client.Location)
+	}
+	return t
+}
+
+// logoURL makes logo an absolute URL, resolving relative paths against
+// LogoBaseURL and protocol-relative ones like "//host/logo.png" as https.
+// Values that cannot be parsed are dropped.
+func (client *WuliuClient) logoURL(logo string) string {
+	logo = strings.TrimSpace(logo)
+	if logo == "" {
+		return ""
+	}
+	u, err := url.Parse(logo)
+	if err != nil {
+		return ""
+	}
+	if u.Scheme == "" && u.Host != "" {
+		u.Scheme = "https"
+	}
+	if u.IsAbs() {
+		return u.String()
+	}
+	baseURL := client.LogoBaseURL
+	if baseURL == "" {
+		baseURL = DefaultWuliuLogoBaseURL
+	}
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return ""
+	}
+	return base.ResolveReference(u).String()
+}
+
+var takeTimePattern = regexp.MustCompile(`(\d+)\s*(天|小时|时|分钟|分|秒)`)
+
+// parseTakeTime parses durations like "2天20小时14分", returning 0 for values
+// it does not understand.
+func parseTakeTime(takeTime string) time.Duration {
+	var d time.Duration
+	for _, m := range takeTimePattern.FindAllStringSubmatch(takeTime, -1) {
+		n, _ := strconv.Atoi(m[1])
+		switch m[2] {
+		case "天":
+			d += time.Duration(n) * 24 * time.Hour
+		case "小时", "时":
+			d += time.Duration(n) * time.Hour
+		case "分钟", "分":
+			d += time.Duration(n) * time.Minute
+		case "秒":
+			d += time.Duration(n) * time.Second
+		}
+	}
+	return d
+}
+
+// splitPhones splits the phones of expPhone, which may hold several separated
+// by commas or the like.
+func splitPhones(phones string) []string {
+	fields := strings.FieldsFunc(phones, func(r rune) bool {
+		return strings.ContainsRune(",，;；、/", r)
+	})
+	result := []string{}
+	for _, field := range fields {
+		if field = strings.TrimSpace(field); field != "" {
+			result = append(result, field)
+		}
+	}
+	return result
+}
+
+var phonePattern = regexp.MustCompile(`(?:^|\D)(1[3-9]\d{9})(?:\D|$)`)
+
+func findPhone(items []WuliuStatusItem) string {
+	for _, item := range items {
+		if m := phonePattern.FindStringSubmatch(item.Desc); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+var (
+	ErrInvalidNumber  = errors.New("invalid tracking number")
+	ErrNoTrackingInfo = errors.New("no tracking info yet")
+)
+
+// NormalizeNumber cleans up a pasted tracking number: full-width characters
+// are converted to ASCII, then whitespace and the separators "-", "_", "‐",
+// "–" and "—" are removed.
+func NormalizeNumber(no string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 0xFF01 && r <= 0xFF5E {
+			r -= 0xFEE0
+		}
+		switch {
+		case unicode.IsSpace(r):
+			return -1
+		case r == '-', r == '_', r == '‐', r == '–', r == '—':
+			return -1
+		}
+		return r
+	}, no)
+}
+
+// numberFormats maps carrier codes to the formats of their tracking numbers.
+// The formats of the carriers of RequiresPhone allow a ":1234" suffix with the
+// last four digits of a phone.
+var numberFormats = map[string]*regexp.Regexp{
+	"SFEXPRESS": regexp.MustCompile(`^(SF\d{13}|\d{12})(:\d{4})?$`),
+	"YTO":       regexp.MustCompile(`^YT\d{13}$`),
+	"ZTO":       regexp.MustCompile(`^\d{12,14}(:\d{4})?$`),
+	"STO":       regexp.MustCompile(`^\d{12,13}$`),
+	"YUNDA":     regexp.MustCompile(`^\d{13,15}$`),
+	"EMS":       regexp.MustCompile(`^([A-Z]{2}\d{9}[A-Z]{2}|\d{13})$`),
+	"JD":        regexp.MustCompile(`^JD[0-9A-Z]{13,15}$`),
+}
+
+// ValidateNumber checks no against the known format of the carrier code,
+// returning an error wrapping ErrInvalidNumber if it does not match. Numbers
+// of carriers without a known format are always valid.
+func ValidateNumber(code, no string) error {
+	format, ok := numberFormats[code]
+	if !ok || format.MatchString(no) {
+		return nil
+	}
+	return fmt.Errorf("%w %q for carrier %s", ErrInvalidNumber, no, code)
+}
+
+// phoneCarriers are the carrier codes that only return the tracking info of
+// numbers with the ":1234" suffix of the last four digits of the phone of the
+// sender or receiver. Add codes here as carriers start requiring it.
+var phoneCarriers = map[string]bool{
+	"SFEXPRESS": true,
+	"FENGWANG":  true,
+	"ZTO":       true,
+}
+
+// RequiresPhone reports whether the carrier of code needs the last four digits
+// of a phone after the number, like "SF1234567890123:1234".
+func RequiresPhone(code string) bool {
+	return phoneCarriers[code]
+}
+
+type WuliuQuery struct {
+	Code   string
+	Number string
+}
+
+type WuliuBatchResult struct {
+	WuliuQuery
+	Status *WuliuStatus
+	Err    error
+}
+
+type BatchOptions struct {
+	Concurrency int // defaults to 5
+	RetryBudget int // total retries shared by all queries, 0 for no limit
+}
+
+// BatchGetStatus gets the status of every query concurrently, returning the
+// results in the same order as queries.
+func (client *WuliuClient) BatchGetStatus(ctx context.Context, queries []WuliuQuery, opts BatchOptions) []WuliuBatchResult {
+	if opts.RetryBudget > 0 {
+		ctx = WithRetryBudget(ctx, NewRetryBudget(opts.RetryBudget))
+	}
+	results := make([]WuliuBatchResult, len(queries))
+	forEach(len(queries), opts.Concurrency, func(i int) {
+		status, err := client.GetStatusForNumber(ctx, queries[i].Code, queries[i].Number)
+		results[i] = WuliuBatchResult{
+			WuliuQuery: queries[i],
+			Status:     status,
+			Err:        err,
+		}
+	})
+	return results
+}
+
+// GetStatusesForNumbers gets the status of many numbers of the same carrier
+// concurrently, under the RateLimiter of the client if set, returning the
+// results by number.
+func (client *WuliuClient) GetStatusesForNumbers(ctx context.Context, code string, numbers []string) map[string]WuliuBatchResult {
+	queries := make([]WuliuQuery, len(numbers))
+	for i, no := range numbers {
+		queries[i] = WuliuQuery{Code: code, Number: no}
+	}
+	results := make(map[string]WuliuBatchResult, len(numbers))
+	for _, result := range client.BatchGetStatus(ctx, queries, BatchOptions{}) {
+		results[result.Number] = result
+	}
+	return results
+}
+
+type WuliuTracking struct {
+	Results      []WuliuBatchResult // latest activity first, failed queries last
+	AllDelivered bool               // whether every parcel is signed
+}
+
+// TrackAll gets the status of every parcel of an order shipped in several.
+func (client *WuliuClient) TrackAll(ctx context.Context, queries []WuliuQuery) *WuliuTracking {
+	results := client.BatchGetStatus(ctx, queries, BatchOptions{})
+	latest := func(result WuliuBatchResult) time.Time {
+		if result.Status == nil {
+			return time.Time{}
+		}
+		t := result.Status.UpdatedAt
+		if item, ok := result.Status.latestItem(); ok && item.Time.After(t) {
+			t = item.Time
+		}
+		return t
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if (results[i].Err == nil) != (results[j].Err == nil) {
+			return results[i].Err == nil
+		}
+		return latest(results[i]).After(latest(results[j]))
+	})
+	allDelivered := len(results) > 0
+	for _, result := range results {
+		if result.Err != nil || !(result.Status.Signed || result.Status.Status == StatusSigned) {
+			allDelivered = false
+		}
+	}
+	return &WuliuTracking{
+		Results:      results,
+		AllDelivered: allDelivered,
+	}
 }
@@ -0,0 +1,410 @@
+package alicloudapislim
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFindPhone(t *testing.T) {
+	tests := []struct {
+		desc string
+		want string
+	}{
+		{"【深圳市】快递员张三(13812345678)正在派件", "13812345678"},
+		{"派件员：李四 电话：15900001111，请保持电话畅通", "15900001111"},
+		{"18600002222", "18600002222"},
+		{"运单号 1381234567890 已揽收", ""}, // 13 digits, not a phone
+		{"订单 913812345678 已发出", ""},   // phone inside a longer number
+		{"客服电话 95338", ""},
+	}
+	for _, test := range tests {
+		got := findPhone([]WuliuStatusItem{{Desc: test.desc}})
+		if got != test.want {
+			t.Errorf("findPhone(%q) = %q, want %q", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestGetStatusForNumberOddExtra(t *testing.T) {
+	client := NewWuliuClient("appcode", WithEndpoint("http://127.0.0.1:0"))
+	if _, err := client.GetStatusForNumber(context.Background(), "SFEXPRESS", "SF1234567890123", "mobile"); err == nil {
+		t.Error("GetStatusForNumber with an odd number of extra parameters should fail")
+	}
+}
+
+func TestRefreshProvidersInvalidInterval(t *testing.T) {
+	client := NewWuliuClient("appcode")
+	defer client.Close()
+	if err := client.RefreshProviders(0); err == nil {
+		t.Error("RefreshProviders(0) should fail")
+	}
+	if client.refreshing {
+		t.Error("RefreshProviders(0) should not start refreshing")
+	}
+}
+
+func TestParseTakeTime(t *testing.T) {
+	tests := []struct {
+		takeTime string
+		want     time.Duration
+	}{
+		{"2天20小时14分", 68*time.Hour + 14*time.Minute},
+		{"3小时5分钟30秒", 3*time.Hour + 5*time.Minute + 30*time.Second},
+		{"", 0},
+		{"未知", 0},
+	}
+	for _, test := range tests {
+		if got := parseTakeTime(test.takeTime); got != test.want {
+			t.Errorf("parseTakeTime(%q) = %v, want %v", test.takeTime, got, test.want)
+		}
+	}
+}
+
+// kdiInTransit is a kdi response of a shipment in transit.
+const kdiInTransit = `{
+  "status": "0",
+  "msg": "ok",
+  "result": {
+    "number": "YT1234567890123",
+    "type": "YTO",
+    "list": [
+      {"time": "2023-05-03 08:10:00", "status": "【杭州转运中心】已发出，下一站【深圳转运中心】"},
+      {"time": "2023-05-01 12:00:00", "status": "【杭州市】已揽收"}
+    ],
+    "deliverystatus": "1",
+    "issign": "0",
+    "expName": "圆通速递",
+    "updateTime": "2023-05-03 08:10:00",
+    "takeTime": "2天20小时14分"
+  }
+}`
+
+func TestGetStatusForNumberInTransit(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		body     string
+		elapsed  time.Duration
+		signed   bool
+		takeTime string
+	}{
+		{"in transit", kdiInTransit, 68*time.Hour + 14*time.Minute, false, "2天20小时14分"},
+		{"no take time", strings.Replace(kdiInTransit, `"2天20小时14分"`, `""`, 1), 0, false, ""},
+		{"signed", strings.Replace(kdiInTransit, `"issign": "0"`, `"issign": "1"`, 1), 68*time.Hour + 14*time.Minute, true, "2天20小时14分"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, test.body)
+			}))
+			defer server.Close()
+			client := NewWuliuClient("appcode", WithEndpoint(server.URL))
+			status, err := client.GetStatusForNumber(context.Background(), "YTO", "YT1234567890123")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status.TimeElapsed != test.takeTime || status.Elapsed != test.elapsed {
+				t.Errorf("got TimeElapsed %q and Elapsed %v, want %q and %v", status.TimeElapsed, status.Elapsed, test.takeTime, test.elapsed)
+			}
+			if status.Signed != test.signed {
+				t.Errorf("got Signed %v, want %v", status.Signed, test.signed)
+			}
+			if status.Status != StatusInTransit || len(status.Items) != 2 {
+				t.Errorf("got status %q with %d items, want %q with 2", status.Status, len(status.Items), StatusInTransit)
+			}
+		})
+	}
+}
+
+func TestWuliuEndpointCheck(t *testing.T) {
+	tests := []struct {
+		endpoint wuliuEndpoint
+		status   string
+		ok       bool
+	}{
+		{wuliuExpressList, "200", true},
+		{wuliuExpressList, "0", false},
+		{wuliuExCompany, "0", true},
+		{wuliuExCompany, "200", false},
+		{wuliuKdi, "0", true},
+		{wuliuKdi, "200", false},
+	}
+	for _, test := range tests {
+		err := test.endpoint.check(test.status, "msg")
+		if test.ok {
+			if err != nil {
+				t.Errorf("%s: check(%q) = %v, want success", test.endpoint.path, test.status, err)
+			}
+			continue
+		}
+		var wuliuErr *WuliuError
+		if !errors.As(err, &wuliuErr) || wuliuErr.Status != test.status {
+			t.Errorf("%s: check(%q) = %v, want a WuliuError with status %s", test.endpoint.path, test.status, err, test.status)
+		}
+	}
+}
+
+func TestRefreshProvidersClose(t *testing.T) {
+	started, aborted := make(chan struct{}), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		close(aborted)
+	}))
+	defer server.Close()
+	client := NewWuliuClient("appcode", WithEndpoint(server.URL))
+	if err := client.RefreshProviders(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	client.Close()
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not abort the refresh in progress")
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		client.mu.Lock()
+		refreshing := client.refreshing
+		client.mu.Unlock()
+		if !refreshing {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("refreshing did not stop after Close")
+		}
+	}
+}
+
+func TestGetProvidersCachesEmptyResult(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		io.WriteString(w, `{"status":"200","msg":"ok","result":{}}`)
+	}))
+	defer server.Close()
+	client := NewWuliuClient("appcode", WithEndpoint(server.URL))
+	for i := 0; i < 2; i++ {
+		providers, err := client.GetProviders(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(providers) != 0 {
+			t.Errorf("GetProviders() = %+v, want no providers", providers)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("got %d requests, want 1", requests)
+	}
+}
+
+func TestGetStatusForNumberWithoutDeliveryStatus(t *testing.T) {
+	body := strings.Replace(kdiInTransit, `"deliverystatus": "1",`, "", 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer server.Close()
+	for _, test := range []struct {
+		infer bool
+		want  string
+	}{
+		{false, StatusUnknown},
+		{true, StatusInTransit},
+	} {
+		client := NewWuliuClient("appcode", WithEndpoint(server.URL))
+		client.InferMissingStatus = test.infer
+		status, err := client.GetStatusForNumber(context.Background(), "YTO", "YT1234567890123")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Status != test.want || status.DeliveryStatus != "" {
+			t.Errorf("InferMissingStatus %v: got status %q and DeliveryStatus %q, want %q and none", test.infer, status.Status, status.DeliveryStatus, test.want)
+		}
+	}
+}
+
+func TestLogoURL(t *testing.T) {
+	tests := []struct {
+		base string
+		logo string
+		want string
+	}{
+		{"", "https://img.example.com/express/yto.png", "https://img.example.com/express/yto.png"},
+		{"", "/express/yto.png", "https://wuliu.market.alicloudapi.com/express/yto.png"},
+		{"", "//cdn.example.com/yto.png", "https://cdn.example.com/yto.png"},
+		{"https://img.example.com/", "/express/yto.png", "https://img.example.com/express/yto.png"},
+		{"https://img.example.com/express/", "yto.png", "https://img.example.com/express/yto.png"},
+		{"https://img.example.com/", "//cdn.example.com/yto.png", "https://cdn.example.com/yto.png"},
+		{"", "http://img.example.com/yto.png", "http://img.example.com/yto.png"},
+		{"", "%zz", ""},
+		{"", " ", ""},
+	}
+	for _, test := range tests {
+		// logos do not depend on the endpoint
+		client := NewWuliuClient("appcode", WithEndpoint("http://127.0.0.1:8080"))
+		client.LogoBaseURL = test.base
+		if got := client.logoURL(test.logo); got != test.want {
+			t.Errorf("logoURL(%q) with base %q = %q, want %q", test.logo, test.base, got, test.want)
+		}
+	}
+}
+
+func TestWuliuErrorKinds(t *testing.T) {
+	tests := []struct {
+		err          WuliuError
+		unauthorized bool
+		quota        bool
+	}{
+		{WuliuError{StatusCode: 400, Message: "Invalid AppCode"}, true, false},
+		{WuliuError{StatusCode: 401, Message: "Invalid AppCode"}, true, false},
+		{WuliuError{StatusCode: 403, Message: "Invalid AppCode `not exists`"}, true, false},
+		{WuliuError{StatusCode: 403, Message: "Unauthorized"}, true, false},
+		{WuliuError{StatusCode: 403, Message: "Api Market Subscription expired"}, true, false},
+		{WuliuError{StatusCode: 403, Message: "Quota Exhausted"}, false, true},
+		{WuliuError{StatusCode: 403, Message: "Api Market Subscription quota exhausted"}, false, true},
+		{WuliuError{StatusCode: 403, Message: "Throttled by USER Flow Control"}, false, false},
+		{WuliuError{StatusCode: 500, Message: "Quota Exhausted"}, false, false},
+		{WuliuError{StatusCode: 200, Status: "205", Message: "Unauthorized"}, false, false},
+	}
+	for _, test := range tests {
+		if got := test.err.IsUnauthorized(); got != test.unauthorized {
+			t.Errorf("IsUnauthorized() of %+v = %v, want %v", test.err, got, test.unauthorized)
+		}
+		if got := test.err.IsQuotaExceeded(); got != test.quota {
+			t.Errorf("IsQuotaExceeded() of %+v = %v, want %v", test.err, got, test.quota)
+		}
+	}
+}
+
+func TestWuliuClientClosed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/exCompany" {
+			io.WriteString(w, `{"status":"0","msg":"ok","list":[{"type":"YTO","name":"圆通速递"}]}`)
+			return
+		}
+		io.WriteString(w, `{"status":"200","msg":"ok","result":{"YTO":"圆通速递"}}`)
+	}))
+	defer server.Close()
+	client := NewWuliuClient("appcode", WithEndpoint(server.URL))
+	client.NumberCacheSize = 10
+	ctx := context.Background()
+	// warm the caches first
+	if _, err := client.GetProviders(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetProvidersForNumber(ctx, "YT1234567890123"); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{"GetProviders", func() error { _, err := client.GetProviders(ctx); return err }},
+		{"GetProviderMap", func() error { _, err := client.GetProviderMap(ctx); return err }},
+		{"GetProvidersForNumber", func() error { _, err := client.GetProvidersForNumber(ctx, "YT1234567890123"); return err }},
+		{"GetStatusForNumber", func() error { _, err := client.GetStatusForNumber(ctx, "YTO", "YT1234567890123"); return err }},
+	}
+	for _, test := range tests {
+		if err := test.call(); !errors.Is(err, ErrClosed) {
+			t.Errorf("%s after Close = %v, want ErrClosed", test.name, err)
+		}
+	}
+}
+
+func TestGetProvidersForNumberCache(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		io.WriteString(w, `{"status":"0","msg":"ok","list":[{"type":"YTO","name":"圆通速递"}]}`)
+	}))
+	defer server.Close()
+	client := NewWuliuClient("appcode", WithEndpoint(server.URL))
+	client.NumberCacheSize = 10
+	client.NumberCachePrefix = 6
+	ctx := context.Background()
+	for _, no := range []string{"YT1234567890123", "YT1234999999999", "YT1234567890123"} {
+		providers, err := client.GetProvidersForNumber(ctx, no)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(providers) != 1 || providers[0].Code != "YTO" {
+			t.Fatalf("GetProvidersForNumber(%q) = %+v, want YTO", no, providers)
+		}
+		// changing the result must not change the cache
+		providers[0].Code = "CHANGED"
+	}
+	if requests != 1 {
+		t.Errorf("got %d requests, want 1", requests)
+	}
+}
+
+func TestNormalizeNumber(t *testing.T) {
+	tests := []struct {
+		no   string
+		want string
+	}{
+		{"YT1234567890123", "YT1234567890123"},
+		{" YT 1234 5678 90123\n", "YT1234567890123"},
+		{"SF-1234_5678‐90–12—3", "SF1234567890123"},
+		{"ＹＴ１２３４５６７８９０１２３", "YT1234567890123"},
+		{"SF1234567890123：1234", "SF1234567890123:1234"},
+		{"YT1234　567890123", "YT1234567890123"}, // ideographic space
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := NormalizeNumber(test.no); got != test.want {
+			t.Errorf("NormalizeNumber(%q) = %q, want %q", test.no, got, test.want)
+		}
+	}
+}
+
+func TestGetStatusForNumberNormalizes(t *testing.T) {
+	var no string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		no = r.URL.Query().Get("no")
+		io.WriteString(w, kdiInTransit)
+	}))
+	defer server.Close()
+	client := NewWuliuClient("appcode", WithEndpoint(server.URL))
+	if _, err := client.GetStatusForNumber(context.Background(), "YTO", " YT-1234 5678 90123 "); err != nil {
+		t.Fatal(err)
+	}
+	if no != "YT1234567890123" {
+		t.Errorf("sent number %q, want YT1234567890123", no)
+	}
+}
+
+func TestValidateNumber(t *testing.T) {
+	tests := []struct {
+		code  string
+		no    string
+		valid bool
+	}{
+		{"SFEXPRESS", "SF1234567890123", true},
+		{"SFEXPRESS", "123456789012", true},
+		{"SFEXPRESS", "SF1234567890123:1234", true},
+		{"SFEXPRESS", "SF123", false},
+		{"YTO", "YT1234567890123", true},
+		{"YTO", "YT1234567890123:1234", false},
+		{"YTO", "1234567890123", false},
+		{"ZTO", "1234567890123:1234", true},
+		{"EMS", "EA123456789CN", true},
+		{"EMS", "EA12345678CN", false},
+		{"JD", "JDVA12345678901", true},
+		{"UNKNOWN", "anything", true},
+	}
+	for _, test := range tests {
+		err := ValidateNumber(test.code, test.no)
+		if test.valid && err != nil {
+			t.Errorf("ValidateNumber(%s, %q) = %v, want nil", test.code, test.no, err)
+		}
+		if !test.valid && !errors.Is(err, ErrInvalidNumber) {
+			t.Errorf("ValidateNumber(%s, %q) = %v, want ErrInvalidNumber", test.code, test.no, err)
+		}
+	}
+}